@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"bufio"
+	/* #nosec G501 */
+	"crypto/md5"
+	/* #nosec G505 */
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type BasicAuthConfig struct {
+	Realm string
+	// File is an Apache htpasswd file with bcrypt, {SHA} or $apr1$ hashes.
+	File string
+}
+
+// BasicAuth checks HTTP Basic credentials against an htpasswd file. The file
+// is read on creation and again on Reload.
+type BasicAuth struct {
+	realm string
+	file  string
+
+	mu    sync.RWMutex
+	users map[string]string
+	// dummyHash is compared against for unknown users, so they take as long
+	// to reject as a wrong password. It uses the highest bcrypt cost in the
+	// file.
+	dummyHash []byte
+}
+
+const defaultRealm = "Restricted"
+
+func NewBasicAuth(baconfig *BasicAuthConfig) (*BasicAuth, error) {
+	a := &BasicAuth{realm: baconfig.Realm, file: baconfig.File}
+	if a.realm == "" {
+		a.realm = defaultRealm
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the htpasswd file again. On error the current users are kept.
+func (a *BasicAuth) Reload() error {
+	users, err := readHtpasswd(a.file)
+	if err != nil {
+		return err
+	}
+	dummyHash, err := newDummyHash(users)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.dummyHash = dummyHash
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns the user for valid credentials. Otherwise it responds
+// with 401 and a WWW-Authenticate challenge and returns false. A nil
+// BasicAuth allows every request with an empty user.
+func (a *BasicAuth) Authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if a == nil {
+		return "", true
+	}
+
+	user, password, ok := r.BasicAuth()
+	if ok && a.verify(user, password) {
+		return user, true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.ReplaceAll(a.realm, `"`, `\"`)+`", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return "", false
+}
+
+func (a *BasicAuth) verify(user, password string) bool {
+	a.mu.RLock()
+	hash, found := a.users[user]
+	dummyHash := a.dummyHash
+	a.mu.RUnlock()
+
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return verifyPassword(hash, password)
+}
+
+// newDummyHash hashes a fixed password with the highest bcrypt cost among
+// users, or bcrypt.DefaultCost if there is no bcrypt hash.
+func newDummyHash(users map[string]string) ([]byte, error) {
+	cost := 0
+	for _, hash := range users {
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil && c > cost {
+			cost = c
+		}
+	}
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return bcrypt.GenerateFromPassword([]byte("niwa-dummy-password"), cost)
+}
+
+func verifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		/* #nosec G401 */
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash), []byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	return false
+}
+
+func readHtpasswd(file string) (map[string]string, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid htpasswd line", file, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash for %s", file, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is Apache's variant of the MD5-based crypt.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	/* #nosec G401 */
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	/* #nosec G401 */
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		/* #nosec G401 */
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(pw)
+		}
+		sum = d.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(sum[g[0]])<<16 | uint(sum[g[1]])<<8 | uint(sum[g[2]])
+		for n := 0; n < 4; n++ {
+			b.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	v := uint(sum[11])
+	for n := 0; n < 2; n++ {
+		b.WriteByte(apr1Alphabet[v&0x3f])
+		v >>= 6
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/auth"
+)
+
+func TestBasicAuth(t *testing.T) {
+	a, err := auth.NewBasicAuth(&auth.BasicAuthConfig{Realm: "admin", File: "../../testdata/htpasswd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", "secret", true},
+		{"sha", "secret", true},
+		{"apr1", "secret", true},
+		{"bcrypt", "wrong", false},
+		{"sha", "wrong", false},
+		{"apr1", "wrong", false},
+		{"unknown", "secret", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(tt.user, tt.password)
+		w := httptest.NewRecorder()
+
+		user, ok := a.Authenticate(w, r)
+		if ok != tt.ok {
+			t.Errorf("%s/%s: got: %v, wont: %v", tt.user, tt.password, ok, tt.ok)
+		}
+		if ok && user != tt.user {
+			t.Errorf("got user: %s, wont: %s", user, tt.user)
+		}
+		if !ok && (w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="admin", charset="UTF-8"`) {
+			t.Errorf("%s: got: %d %s, wont: 401 with a challenge", tt.user, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if _, ok := a.Authenticate(w, httptest.NewRequest("GET", "/", nil)); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("got: %v %d, wont: false 401 without credentials", ok, w.Code)
+	}
+}
+
+func TestBasicAuth_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := auth.NewBasicAuth(&auth.BasicAuthConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(user string) bool {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, "secret")
+		_, ok := a.Authenticate(httptest.NewRecorder(), r)
+		return ok
+	}
+
+	if !authenticate("sha") || authenticate("apr1") {
+		t.Fatal("unexpected users before reload")
+	}
+
+	if err := os.WriteFile(file, []byte("apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if authenticate("sha") || !authenticate("apr1") {
+		t.Error("users were not reloaded")
+	}
+
+	// A broken file keeps the current users.
+	if err := os.WriteFile(file, []byte("plain:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+	if !authenticate("apr1") {
+		t.Error("users were dropped by a failed reload")
+	}
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+type ForwardAuthConfig struct {
+	// URL receives a subrequest with the method, URI and headers of every
+	// request before it is allowed.
+	URL string
+	// ResponseHeaders are copied from a 2xx auth response to the request sent
+	// upstream. Values sent by the client for these headers are dropped.
+	ResponseHeaders []string
+	// LoginURL is where clients are redirected when the auth service responds
+	// with 401. The original URL is passed as the "rd" query parameter.
+	LoginURL       string
+	Timeout        time.Duration
+	TrustedProxies []netip.Prefix
+	ErrorLog       *log.Logger
+}
+
+// ForwardAuth delegates the decision to an external service, like nginx
+// auth_request or Traefik ForwardAuth.
+type ForwardAuth struct {
+	url             string
+	responseHeaders []string
+	loginURL        *url.URL
+	trustedProxies  []netip.Prefix
+	client          *http.Client
+	errorLog        *log.Logger
+}
+
+const defaultForwardAuthTimeout = 10 * time.Second
+
+// hopHeaders are not sent to the auth service.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+func NewForwardAuth(faconfig *ForwardAuthConfig) (*ForwardAuth, error) {
+	u, err := url.Parse(faconfig.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("forward auth url is invalid value: " + faconfig.URL)
+	}
+
+	f := &ForwardAuth{
+		url:             faconfig.URL,
+		responseHeaders: faconfig.ResponseHeaders,
+		trustedProxies:  faconfig.TrustedProxies,
+		errorLog:        faconfig.ErrorLog,
+	}
+	if faconfig.LoginURL != "" {
+		if f.loginURL, err = url.Parse(faconfig.LoginURL); err != nil {
+			return nil, errors.New("forward auth login url is invalid value: " + faconfig.LoginURL)
+		}
+	}
+
+	timeout := faconfig.Timeout
+	if timeout == 0 {
+		timeout = defaultForwardAuthTimeout
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		// Redirects from the auth service are meant for the client.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return f, nil
+}
+
+// Authorize sends the subrequest. On a 2xx response it copies the configured
+// headers onto r and returns true. Otherwise it writes the auth service's
+// response, or a redirect to the login URL, and returns the status it wrote.
+// A nil ForwardAuth allows every request.
+func (f *ForwardAuth) Authorize(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if f == nil {
+		return 0, true
+	}
+
+	for _, h := range f.responseHeaders {
+		r.Header.Del(h)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, f.url, http.NoBody)
+	if err != nil {
+		return f.fail(w, err), false
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	f.setForwarded(req, r)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return f.fail(w, err), false
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		for _, h := range f.responseHeaders {
+			if v := res.Header.Values(h); len(v) > 0 {
+				r.Header[http.CanonicalHeaderKey(h)] = v
+			}
+		}
+		return res.StatusCode, true
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && f.loginURL != nil {
+		http.Redirect(w, r, f.loginRedirect(r), http.StatusFound)
+		return http.StatusFound, false
+	}
+
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+	return res.StatusCode, false
+}
+
+// setForwarded describes the original request with X-Forwarded-* headers.
+// Values sent by the client are replaced.
+func (f *ForwardAuth) setForwarded(req, r *http.Request) {
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	if addr, err := clientip.FromRequest(r, f.trustedProxies); err == nil {
+		req.Header.Set("X-Forwarded-For", addr.String())
+	} else {
+		req.Header.Del("X-Forwarded-For")
+	}
+}
+
+func (f *ForwardAuth) loginRedirect(r *http.Request) string {
+	u := *f.loginURL
+	q := u.Query()
+	q.Set("rd", requestScheme(r)+"://"+r.Host+r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (f *ForwardAuth) fail(w http.ResponseWriter, err error) int {
+	if f.errorLog != nil {
+		f.errorLog.Printf("forward auth: %v", err)
+	} else {
+		log.Printf("forward auth: %v", err)
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return http.StatusInternalServerError
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
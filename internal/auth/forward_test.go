@@ -0,0 +1,116 @@
+package auth_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/auth"
+)
+
+func TestForwardAuth(t *testing.T) {
+	var got *http.Request
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		switch r.Header.Get("Authorization") {
+		case "Bearer valid":
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Other", "ignored")
+			w.WriteHeader(http.StatusNoContent)
+		case "Bearer forbidden":
+			w.Header().Set("X-Reason", "suspended")
+			http.Error(w, "suspended", http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer authServer.Close()
+
+	f, err := auth.NewForwardAuth(&auth.ForwardAuthConfig{URL: authServer.URL + "/verify", ResponseHeaders: []string{"X-User"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("DELETE", "http://example.com/app/users?id=1", nil)
+	r.Header.Set("Authorization", "Bearer valid")
+	r.Header.Set("X-User", "spoofed")
+	r.Header.Set("X-Forwarded-Uri", "/spoofed")
+	w := httptest.NewRecorder()
+
+	if _, ok := f.Authorize(w, r); !ok {
+		t.Fatalf("got: denied %d, wont: allowed", w.Code)
+	}
+	if got.Method != "DELETE" || got.URL.Path != "/verify" {
+		t.Errorf("got subrequest: %s %s, wont: DELETE /verify", got.Method, got.URL.Path)
+	}
+	if got.Header.Get("X-Forwarded-Method") != "DELETE" || got.Header.Get("X-Forwarded-Uri") != "/app/users?id=1" || got.Header.Get("X-Forwarded-Host") != "example.com" {
+		t.Errorf("got forwarded headers: %v", got.Header)
+	}
+	if got.Header.Get("Authorization") != "Bearer valid" || got.Header.Get("X-User") != "" {
+		t.Errorf("got original headers: %v", got.Header)
+	}
+	if r.Header.Get("X-User") != "alice" || r.Header.Get("X-Other") != "" {
+		t.Errorf("got upstream headers: %v", r.Header)
+	}
+
+	r = httptest.NewRequest("GET", "http://example.com/app", nil)
+	r.Header.Set("Authorization", "Bearer forbidden")
+	w = httptest.NewRecorder()
+
+	status, ok := f.Authorize(w, r)
+	if ok || status != http.StatusForbidden || w.Code != http.StatusForbidden {
+		t.Fatalf("got: %v %d %d, wont: denied 403", ok, status, w.Code)
+	}
+	if w.Header().Get("X-Reason") != "suspended" {
+		t.Errorf("auth response headers were not copied: %v", w.Header())
+	}
+	if body, _ := io.ReadAll(w.Body); string(body) != "suspended\n" {
+		t.Errorf("got body: %q", body)
+	}
+}
+
+func TestForwardAuth_LoginURL(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer authServer.Close()
+
+	f, err := auth.NewForwardAuth(&auth.ForwardAuthConfig{URL: authServer.URL, LoginURL: "https://login.example.com/?app=niwa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	status, ok := f.Authorize(w, httptest.NewRequest("GET", "http://example.com/app?x=1", nil))
+	if ok || status != http.StatusFound || w.Code != http.StatusFound {
+		t.Fatalf("got: %v %d %d, wont: denied 302", ok, status, w.Code)
+	}
+
+	wont := "https://login.example.com/?app=niwa&rd=http%3A%2F%2Fexample.com%2Fapp%3Fx%3D1"
+	if got := w.Header().Get("Location"); got != wont {
+		t.Errorf("got: %s, wont: %s", got, wont)
+	}
+}
+
+func TestForwardAuth_Unavailable(t *testing.T) {
+	authServer := httptest.NewServer(http.NotFoundHandler())
+	url := authServer.URL
+	authServer.Close()
+
+	f, err := auth.NewForwardAuth(&auth.ForwardAuthConfig{URL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if status, ok := f.Authorize(w, httptest.NewRequest("GET", "/", nil)); ok || status != http.StatusInternalServerError {
+		t.Errorf("got: %v %d, wont: denied 500", ok, status)
+	}
+}
+
+func TestForwardAuth_InvalidURL(t *testing.T) {
+	if _, err := auth.NewForwardAuth(&auth.ForwardAuthConfig{URL: "auth.example.com"}); err == nil {
+		t.Error("expected an error for a URL without a scheme")
+	}
+}
@@ -0,0 +1,502 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JWTConfig struct {
+	Realm    string
+	Issuer   string
+	Audience []string
+	// Algorithms limits the accepted "alg" values. Every supported asymmetric
+	// algorithm is accepted when empty.
+	Algorithms []string
+	// KeyFile is a JWKS document or PEM public keys and certificates.
+	KeyFile string
+	// ClaimHeaders maps claim names to the request headers they are forwarded
+	// upstream in. Values sent by the client for these headers are dropped.
+	ClaimHeaders map[string]string
+	// Leeway is the allowed clock skew for exp and nbf.
+	Leeway time.Duration
+	// AllowMissingExp accepts tokens without an exp claim. They are rejected
+	// by default.
+	AllowMissingExp bool
+}
+
+// JWT validates bearer tokens signed with RSA, ECDSA or Ed25519 keys.
+type JWT struct {
+	realm        string
+	issuer       string
+	audience     []string
+	algorithms   []string
+	keyFile      string
+	claimHeaders map[string]string
+	leeway       time.Duration
+	requireExp   bool
+	now          func() time.Time
+
+	mu   sync.RWMutex
+	keys []jwk
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+func NewJWT(jwtconfig *JWTConfig) (*JWT, error) {
+	j := &JWT{
+		realm:        jwtconfig.Realm,
+		issuer:       jwtconfig.Issuer,
+		audience:     jwtconfig.Audience,
+		algorithms:   jwtconfig.Algorithms,
+		keyFile:      jwtconfig.KeyFile,
+		claimHeaders: jwtconfig.ClaimHeaders,
+		leeway:       jwtconfig.Leeway,
+		requireExp:   !jwtconfig.AllowMissingExp,
+		now:          time.Now,
+	}
+	if j.realm == "" {
+		j.realm = defaultRealm
+	}
+	if len(j.algorithms) == 0 {
+		j.algorithms = jwtAlgorithms
+	}
+	for _, alg := range j.algorithms {
+		if !slices.Contains(jwtAlgorithms, alg) {
+			return nil, errors.New("jwt algorithm is invalid value: " + alg)
+		}
+	}
+
+	if err := j.Reload(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Reload reads the key file again. On error the current keys are kept.
+func (j *JWT) Reload() error {
+	keys, err := readKeys(j.keyFile)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// Authenticate validates the bearer token and returns its claims, formatted
+// as strings. The configured claims are set on r as headers. For a missing or
+// invalid token it responds with 401 and a WWW-Authenticate challenge and
+// returns false. A nil JWT allows every request with no claims.
+func (j *JWT) Authenticate(w http.ResponseWriter, r *http.Request) (map[string]string, bool) {
+	if j == nil {
+		return nil, true
+	}
+
+	for _, h := range j.claimHeaders {
+		r.Header.Del(h)
+	}
+
+	challenge := `Bearer realm="` + strings.ReplaceAll(j.realm, `"`, `\"`) + `"`
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	claims, err := j.validate(strings.TrimSpace(token))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", challenge+`, error="invalid_token", error_description="`+err.Error()+`"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	values := make(map[string]string, len(claims))
+	for k, v := range claims {
+		values[k] = claimString(v)
+	}
+	for claim, h := range j.claimHeaders {
+		if v, found := values[claim]; found {
+			r.Header.Set(h, v)
+		}
+	}
+	return values, true
+}
+
+func (j *JWT) validate(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	if !slices.Contains(j.algorithms, header.Alg) {
+		return nil, errors.New("unexpected algorithm")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if !j.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if err := j.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (j *JWT) validateClaims(claims map[string]any) error {
+	now := j.now()
+	if exp, found := claims["exp"]; found {
+		t, ok := numericDate(exp)
+		if !ok || !now.Before(t.Add(j.leeway)) {
+			return errors.New("token is expired")
+		}
+	} else if j.requireExp {
+		return errors.New("token has no expiration")
+	}
+	if nbf, found := claims["nbf"]; found {
+		t, ok := numericDate(nbf)
+		if !ok || now.Add(j.leeway).Before(t) {
+			return errors.New("token is not valid yet")
+		}
+	}
+
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return errors.New("unexpected issuer")
+		}
+	}
+
+	if len(j.audience) != 0 {
+		var aud []string
+		switch v := claims["aud"].(type) {
+		case string:
+			aud = []string{v}
+		case []any:
+			for _, a := range v {
+				if s, ok := a.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+		if !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(j.audience, a) }) {
+			return errors.New("unexpected audience")
+		}
+	}
+	return nil
+}
+
+// verify tries every key that matches the kid and can be used with alg.
+func (j *JWT) verify(alg, kid string, signed, sig []byte) bool {
+	j.mu.RLock()
+	keys := j.keys
+	j.mu.RUnlock()
+
+	for _, k := range keys {
+		if (kid != "" && k.kid != "" && k.kid != kid) || (k.alg != "" && k.alg != alg) {
+			continue
+		}
+		if verifySignature(alg, k.key, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' && alg[0] != 'P' {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig) == nil
+		}
+		return rsa.VerifyPSS(key, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' || alg == "EdDSA" {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if ecdsaCurve(alg) != key.Curve || len(sig) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+func ecdsaCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// claimString formats a claim for a header or the access log. Lists of
+// strings are joined with commas, other values are written as JSON.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		var values []string
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				b, _ := json.Marshal(v)
+				return string(b)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ",")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func readKeys(file string) ([]jwk, error) {
+	b, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+	if b = bytes.TrimSpace(b); bytes.HasPrefix(b, []byte("{")) {
+		keys, err = parseJWKS(b)
+	} else {
+		keys, err = parsePEMKeys(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", file)
+	}
+	return keys, nil
+}
+
+func parsePEMKeys(b []byte) ([]jwk, error) {
+	var keys []jwk
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			return keys, nil
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, errors.New("unsupported PEM block: " + block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwk{key: key})
+	}
+}
+
+func parseJWKS(b []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaJWK(k.N, k.E)
+		case "EC":
+			key, err = ecJWK(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = okpJWK(k.Crv, k.X)
+		default:
+			// Symmetric and unknown key types are never used.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+func rsaJWK(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func ecJWK(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var ecdhCurve ecdh.Curve
+	switch crv {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, errors.New("unsupported curve: " + crv)
+	}
+
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(xb) != size || len(yb) != size {
+		return nil, errors.New("invalid EC key")
+	}
+	// ecdh rejects points that are not on the curve.
+	if _, err := ecdhCurve.NewPublicKey(append(append([]byte{4}, xb...), yb...)); err != nil {
+		return nil, errors.New("invalid EC key")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}, nil
+}
+
+func okpJWK(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, errors.New("unsupported curve: " + crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil || len(xb) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid OKP key")
+	}
+	return ed25519.PublicKey(xb), nil
+}
@@ -0,0 +1,226 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/auth"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, serr := ecdsa.Sign(rand.Reader, k, sum[:])
+		err = serr
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func authenticateJWT(j *auth.JWT, token string) (*httptest.ResponseRecorder, *http.Request, map[string]string, bool) {
+	r := httptest.NewRequest("GET", "/api", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.Header.Set("X-User-Id", "spoofed")
+	w := httptest.NewRecorder()
+	claims, ok := j.Authenticate(w, r)
+	return w, r, claims, ok
+}
+
+func TestJWT_PEM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := auth.NewJWT(&auth.JWTConfig{
+		Realm:        "api",
+		Issuer:       "https://issuer.example.com",
+		Audience:     []string{"niwa"},
+		Algorithms:   []string{"RS256"},
+		KeyFile:      file,
+		ClaimHeaders: map[string]string{"sub": "X-User-Id", "roles": "X-User-Roles"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]any{"iss": "https://issuer.example.com", "aud": []string{"other", "niwa"}, "sub": "alice", "roles": []string{"admin", "dev"}, "exp": exp}
+
+	w, r, claims, ok := authenticateJWT(j, signJWT(t, "RS256", "", key, valid))
+	if !ok {
+		t.Fatalf("got: %d %s, wont: valid", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if claims["sub"] != "alice" || claims["aud"] != "other,niwa" {
+		t.Errorf("got claims: %v", claims)
+	}
+	if r.Header.Get("X-User-Id") != "alice" || r.Header.Get("X-User-Roles") != "admin,dev" {
+		t.Errorf("got headers: %v", r.Header)
+	}
+
+	with := func(k string, v any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		c[k] = v
+		return c
+	}
+
+	without := func(k string) map[string]any {
+		c := with(k, nil)
+		delete(c, k)
+		return c
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		error string
+	}{
+		{"expired", signJWT(t, "RS256", "", key, with("exp", time.Now().Add(-time.Minute).Unix())), "token is expired"},
+		{"no expiration", signJWT(t, "RS256", "", key, without("exp")), "token has no expiration"},
+		{"not yet valid", signJWT(t, "RS256", "", key, with("nbf", time.Now().Add(time.Hour).Unix())), "token is not valid yet"},
+		{"issuer", signJWT(t, "RS256", "", key, with("iss", "https://evil.example.com")), "unexpected issuer"},
+		{"audience", signJWT(t, "RS256", "", key, with("aud", "other")), "unexpected audience"},
+		{"signature", signJWT(t, "RS256", "", other, valid), "invalid signature"},
+		{"algorithm", b64([]byte(`{"alg":"none"}`)) + "." + strings.Split(signJWT(t, "RS256", "", key, valid), ".")[1] + ".", "unexpected algorithm"},
+		{"malformed", "abc", "malformed token"},
+	}
+
+	for _, tt := range tests {
+		w, r, _, ok := authenticateJWT(j, tt.token)
+		if ok {
+			t.Errorf("%s: got: valid, wont: invalid", tt.name)
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got: %d, wont: 401", tt.name, w.Code)
+		}
+		wont := `Bearer realm="api", error="invalid_token", error_description="` + tt.error + `"`
+		if got := w.Header().Get("WWW-Authenticate"); got != wont {
+			t.Errorf("%s: got: %s, wont: %s", tt.name, got, wont)
+		}
+		if r.Header.Get("X-User-Id") != "" {
+			t.Errorf("%s: client header was forwarded", tt.name)
+		}
+	}
+
+	w, _, _, ok = authenticateJWT(j, "")
+	if ok || w.Header().Get("WWW-Authenticate") != `Bearer realm="api"` {
+		t.Errorf("got: %v %s, wont: a challenge without an error", ok, w.Header().Get("WWW-Authenticate"))
+	}
+
+	j, err = auth.NewJWT(&auth.JWTConfig{Algorithms: []string{"RS256"}, KeyFile: file, AllowMissingExp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, _, _, ok := authenticateJWT(j, signJWT(t, "RS256", "", key, without("exp"))); !ok {
+		t.Errorf("got: %s, wont: valid with allow_missing_exp", w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestJWT_JWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+		{"kty": "oct", "kid": "secret", "k": b64([]byte("secret"))},
+	}})
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := auth.NewJWT(&auth.JWTConfig{KeyFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, claims), true},
+		{"EdDSA", signJWT(t, "EdDSA", "ed", edKey, claims), true},
+		{"EdDSA without kid", signJWT(t, "EdDSA", "", edKey, claims), true},
+		{"kid mismatch", signJWT(t, "ES256", "ed", ecKey, claims), false},
+	}
+
+	for _, tt := range tests {
+		if w, _, _, ok := authenticateJWT(j, tt.token); ok != tt.ok {
+			t.Errorf("%s: got: %v %s, wont: %v", tt.name, ok, w.Header().Get("WWW-Authenticate"), tt.ok)
+		}
+	}
+}
+
+func TestJWT_InvalidConfig(t *testing.T) {
+	if _, err := auth.NewJWT(&auth.JWTConfig{KeyFile: "../../testdata/jwks.json", Algorithms: []string{"HS256"}}); err == nil {
+		t.Error("expected an error for a symmetric algorithm")
+	}
+	if _, err := auth.NewJWT(&auth.JWTConfig{KeyFile: "../../testdata/htpasswd"}); err == nil {
+		t.Error("expected an error for a file without keys")
+	}
+}
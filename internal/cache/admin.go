@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"net/http"
+)
+
+// PurgeHandler serves the admin API for the cache:
+//
+//	DELETE /cache?key=example.com/users?page=2
+//
+// It responds with 204 when the key was stored and 404 otherwise.
+func PurgeHandler(c *Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "key is missing", http.StatusBadRequest)
+			return
+		}
+
+		if c == nil || !c.Purge(key) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type CacheConfig struct {
+	// Store is "memory" (default) or "disk".
+	Store                string
+	Path                 string
+	MaxSize              int64
+	MaxEntrySize         int64
+	StaleWhileRevalidate time.Duration
+}
+
+// Cache is an HTTP cache shared by the proxies that enable it. Entries are
+// keyed by the downstream host and request URI, see Key.
+type Cache struct {
+	store                store
+	maxEntrySize         int64
+	staleWhileRevalidate time.Duration
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// StatusHeader reports how a response was served: HIT, MISS, STALE,
+// REVALIDATED, EXPIRED or BYPASS.
+const StatusHeader = "X-Cache-Status"
+
+const (
+	statusHit         = "HIT"
+	statusMiss        = "MISS"
+	statusStale       = "STALE"
+	statusRevalidated = "REVALIDATED"
+	statusExpired     = "EXPIRED"
+	statusBypass      = "BYPASS"
+)
+
+const (
+	defaultMaxSize      = 64 << 20
+	defaultMaxEntrySize = 8 << 20
+)
+
+type keyContextKey struct{}
+
+func New(cacheconfig *CacheConfig) (*Cache, error) {
+	c := &Cache{
+		maxEntrySize:         cacheconfig.MaxEntrySize,
+		staleWhileRevalidate: cacheconfig.StaleWhileRevalidate,
+		revalidating:         map[string]bool{},
+	}
+
+	maxSize := cacheconfig.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxSize
+	}
+	if c.maxEntrySize == 0 {
+		c.maxEntrySize = min(defaultMaxEntrySize, maxSize)
+	}
+
+	var err error
+	switch cacheconfig.Store {
+	case "", "memory":
+		c.store = newMemoryStore(maxSize)
+	case "disk":
+		if cacheconfig.Path == "" {
+			return nil, errors.New("cache path is missing")
+		}
+		if c.store, err = newDiskStore(cacheconfig.Path, maxSize); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("cache store is invalid value: " + cacheconfig.Store)
+	}
+
+	return c, nil
+}
+
+// Key returns the cache key of a downstream request, e.g.
+// "example.com/users?page=2". Purge takes the same form.
+func Key(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// WithKey marks an outbound request as cacheable under key.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+func keyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyContextKey{}).(string)
+	return key, ok
+}
+
+// Purge removes every stored variant of key and reports whether anything was
+// stored.
+func (c *Cache) Purge(key string) bool {
+	return c.store.delete(key)
+}
+
+// startRevalidation reports whether the caller should revalidate key in the
+// background; only one revalidation per key runs at a time.
+func (c *Cache) startRevalidation(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return false
+	}
+	c.revalidating[key] = true
+	return true
+}
+
+func (c *Cache) finishRevalidation(key string) {
+	c.mu.Lock()
+	delete(c.revalidating, key)
+	c.mu.Unlock()
+}
@@ -0,0 +1,253 @@
+package cache_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/cache"
+)
+
+type response struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func roundTrip(t *testing.T, rt http.RoundTripper, url string, header http.Header) response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.RequestURI = ""
+	if header != nil {
+		req.Header = header
+	}
+	req = req.WithContext(cache.WithKey(req.Context(), "niwa.test"+req.URL.RequestURI()))
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return response{status: res.StatusCode, header: res.Header, body: string(body)}
+}
+
+func newCache(t *testing.T, cacheconfig *cache.CacheConfig) *cache.Cache {
+	t.Helper()
+	c, err := cache.New(cacheconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCache(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch r.URL.Path {
+		case "/public":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+	defer as.Close()
+
+	tests := []struct {
+		path     string
+		statuses []string
+		bodies   []string
+	}{
+		{path: "/public", statuses: []string{"MISS", "HIT"}, bodies: []string{"/public 1", "/public 1"}},
+		{path: "/expires", statuses: []string{"MISS", "HIT"}, bodies: []string{"/expires 2", "/expires 2"}},
+		{path: "/no-store", statuses: []string{"MISS", "MISS"}, bodies: []string{"/no-store 3", "/no-store 4"}},
+		{path: "/private", statuses: []string{"MISS", "MISS"}, bodies: []string{"/private 5", "/private 6"}},
+		{path: "/none", statuses: []string{"MISS", "MISS"}, bodies: []string{"/none 7", "/none 8"}},
+	}
+
+	rt := newCache(t, &cache.CacheConfig{}).Transport(http.DefaultTransport)
+	for _, tt := range tests {
+		for i := range tt.statuses {
+			res := roundTrip(t, rt, as.URL+tt.path, nil)
+			if got := res.header.Get(cache.StatusHeader); got != tt.statuses[i] || res.body != tt.bodies[i] {
+				t.Errorf("%s #%d: got: %s %s, wont: %s %s", tt.path, i, got, res.body, tt.statuses[i], tt.bodies[i])
+			}
+		}
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}))
+	defer as.Close()
+
+	rt := newCache(t, &cache.CacheConfig{}).Transport(http.DefaultTransport)
+	for _, lang := range []string{"en", "ja", "en", "ja"} {
+		res := roundTrip(t, rt, as.URL, http.Header{"Accept-Language": {lang}})
+		if res.body != lang {
+			t.Errorf("got: %s, wont: %s", res.body, lang)
+		}
+	}
+
+	if hits.Load() != 2 {
+		t.Errorf("got: %d upstream requests, wont: 2", hits.Load())
+	}
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "body")
+	}))
+	defer as.Close()
+
+	rt := newCache(t, &cache.CacheConfig{}).Transport(http.DefaultTransport)
+
+	res := roundTrip(t, rt, as.URL, nil)
+	if res.header.Get(cache.StatusHeader) != "MISS" || res.body != "body" {
+		t.Errorf("got: %s %s, wont: MISS body", res.header.Get(cache.StatusHeader), res.body)
+	}
+
+	res = roundTrip(t, rt, as.URL, nil)
+	if res.status != http.StatusOK || res.header.Get(cache.StatusHeader) != "REVALIDATED" || res.body != "body" {
+		t.Errorf("got: %d %s %s, wont: 200 REVALIDATED body", res.status, res.header.Get(cache.StatusHeader), res.body)
+	}
+
+	// The client's own conditional request is answered from the cache.
+	res = roundTrip(t, rt, as.URL, http.Header{"If-None-Match": {`"v1"`}})
+	if res.status != http.StatusNotModified || res.body != "" {
+		t.Errorf("got: %d %s, wont: 304", res.status, res.body)
+	}
+
+	if hits.Load() != 3 {
+		t.Errorf("got: %d upstream requests, wont: 3", hits.Load())
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer as.Close()
+
+	rt := newCache(t, &cache.CacheConfig{}).Transport(http.DefaultTransport)
+
+	if res := roundTrip(t, rt, as.URL, nil); res.body != "1" {
+		t.Fatalf("got: %s, wont: 1", res.body)
+	}
+
+	res := roundTrip(t, rt, as.URL, nil)
+	if res.header.Get(cache.StatusHeader) != "STALE" || res.body != "1" {
+		t.Errorf("got: %s %s, wont: STALE 1", res.header.Get(cache.StatusHeader), res.body)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		res = roundTrip(t, rt, as.URL, nil)
+		if res.body == "2" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res.body != "2" {
+		t.Errorf("got: %s, wont: 2 after the background revalidation", res.body)
+	}
+}
+
+func TestCache_Purge(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "%d", hits.Add(1))
+	}))
+	defer as.Close()
+
+	c := newCache(t, &cache.CacheConfig{})
+	rt := c.Transport(http.DefaultTransport)
+	roundTrip(t, rt, as.URL+"/users?page=2", nil)
+
+	admin := cache.PurgeHandler(c)
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/cache?key=niwa.test%2Fusers%3Fpage%3D2", nil))
+		if w.Code != status {
+			t.Errorf("got: %d, wont: %d", w.Code, status)
+		}
+	}
+
+	if res := roundTrip(t, rt, as.URL+"/users?page=2", nil); res.body != "2" {
+		t.Errorf("got: %s, wont: 2", res.body)
+	}
+}
+
+func TestCache_Disk(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "%s %d", r.URL.Path, hits.Add(1))
+	}))
+	defer as.Close()
+
+	dir := t.TempDir()
+	rt := newCache(t, &cache.CacheConfig{Store: "disk", Path: dir}).Transport(http.DefaultTransport)
+	roundTrip(t, rt, as.URL+"/a", nil)
+
+	// A new cache on the same directory keeps what was stored.
+	rt = newCache(t, &cache.CacheConfig{Store: "disk", Path: dir}).Transport(http.DefaultTransport)
+	res := roundTrip(t, rt, as.URL+"/a", nil)
+	if res.header.Get(cache.StatusHeader) != "HIT" || res.body != "/a 1" {
+		t.Errorf("got: %s %s, wont: HIT /a 1", res.header.Get(cache.StatusHeader), res.body)
+	}
+}
+
+func TestCache_MaxSize(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer as.Close()
+
+	for _, store := range []string{"memory", "disk"} {
+		hits.Store(0)
+		// Room for one entry only, so storing the second evicts the first.
+		rt := newCache(t, &cache.CacheConfig{Store: store, Path: t.TempDir(), MaxSize: 150}).Transport(http.DefaultTransport)
+		for _, p := range []string{"/a", "/b", "/b", "/a"} {
+			roundTrip(t, rt, as.URL+p, nil)
+		}
+
+		if hits.Load() != 3 {
+			t.Errorf("%s: got: %d upstream requests, wont: 3", store, hits.Load())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry holds the stored variants of a key. Fields are exported for gob.
+type entry struct {
+	Key      string
+	Variants []*variant
+}
+
+type variant struct {
+	Vary         map[string]string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	ResponseTime time.Time
+}
+
+const maxVariants = 16
+
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+func (e *entry) size() int64 {
+	var size int64
+	for _, v := range e.Variants {
+		size += int64(len(v.Body))
+		for k, vs := range v.Header {
+			for _, s := range vs {
+				size += int64(len(k) + len(s))
+			}
+		}
+	}
+	return size
+}
+
+// match returns the variant whose Vary headers match the request.
+func (e *entry) match(req *http.Request) *variant {
+	for _, v := range e.Variants {
+		if v.matches(req) {
+			return v
+		}
+	}
+	return nil
+}
+
+// put replaces the variant with the same Vary values, or adds v.
+func (e *entry) put(v *variant) {
+	for i, old := range e.Variants {
+		if sameVary(old.Vary, v.Vary) {
+			e.Variants[i] = v
+			return
+		}
+	}
+	e.Variants = append(e.Variants, v)
+	if len(e.Variants) > maxVariants {
+		e.Variants = e.Variants[1:]
+	}
+}
+
+func newVariant(req *http.Request, res *http.Response, body []byte, responseTime time.Time) *variant {
+	v := &variant{Vary: map[string]string{}, Status: res.StatusCode, Header: res.Header.Clone(), Body: body, ResponseTime: responseTime}
+	v.Header.Del(StatusHeader)
+	for _, name := range varyHeaders(res.Header) {
+		v.Vary[name] = strings.Join(req.Header.Values(name), ", ")
+	}
+	return v
+}
+
+func (v *variant) matches(req *http.Request) bool {
+	for name, value := range v.Vary {
+		if strings.Join(req.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// age is the current age: the Age the upstream sent plus the time stored.
+func (v *variant) age(now time.Time) time.Duration {
+	age := now.Sub(v.ResponseTime)
+	if s, err := strconv.Atoi(v.Header.Get("Age")); err == nil && s > 0 {
+		age += time.Duration(s) * time.Second
+	}
+	return age
+}
+
+// freshness returns how long the variant is fresh and how long after that it
+// may be served stale while it is revalidated.
+func (v *variant) freshness(defaultStale time.Duration) (time.Duration, time.Duration) {
+	cc := parseCacheControl(v.Header)
+
+	var lifetime time.Duration
+	if _, found := cc["no-cache"]; found {
+		lifetime = 0
+	} else if d, ok := cc.seconds("s-maxage"); ok {
+		lifetime = d
+	} else if d, ok := cc.seconds("max-age"); ok {
+		lifetime = d
+	} else if expires, err := http.ParseTime(v.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(v.Header.Get("Date"))
+		if err != nil {
+			date = v.ResponseTime
+		}
+		lifetime = expires.Sub(date)
+	}
+
+	if _, found := cc["must-revalidate"]; found {
+		return lifetime, 0
+	}
+	if _, found := cc["proxy-revalidate"]; found {
+		return lifetime, 0
+	}
+	if d, ok := cc.seconds("stale-while-revalidate"); ok {
+		return lifetime, d
+	}
+	return lifetime, defaultStale
+}
+
+// storable reports whether a response to a GET may be stored. Only responses
+// with explicit freshness are stored; heuristic freshness isn't used.
+func storable(req *http.Request, res *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatuses[res.StatusCode] {
+		return false
+	}
+	if res.Header.Get("Set-Cookie") != "" || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+
+	cc := parseCacheControl(res.Header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, found := cc[directive]; found {
+			return false
+		}
+	}
+	for _, name := range varyHeaders(res.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	_, noCache := cc["no-cache"]
+	_, sMaxAge := cc.seconds("s-maxage")
+	_, maxAge := cc.seconds("max-age")
+	return noCache || sMaxAge || maxAge || res.Header.Get("Expires") != ""
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			k, val, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if k != "" {
+				cc[strings.ToLower(k)] = strings.Trim(val, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, found := cc[directive]
+	if !found {
+		return 0, false
+	}
+	s, err := strconv.Atoi(v)
+	if err != nil || s < 0 {
+		return 0, false
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, found := b[k]; !found || bv != v {
+			return false
+		}
+	}
+	return true
+}
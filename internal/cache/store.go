@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// store keeps entries within a size limit, evicting the least recently used
+// ones. Stored variants are never modified; updates replace them.
+type store interface {
+	get(key string, req *http.Request) *variant
+	add(key string, v *variant)
+	delete(key string) bool
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *entry
+}
+
+type lru struct {
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, found := l.items[key]
+	if !found {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// set stores the item and returns the keys evicted to make room for it.
+func (l *lru) set(item *lruItem) []string {
+	l.remove(item.key)
+	l.items[item.key] = l.ll.PushFront(item)
+	l.size += item.size
+
+	var evicted []string
+	for l.size > l.maxSize && l.ll.Len() > 0 {
+		oldest := l.ll.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	el, found := l.items[key]
+	if !found {
+		return false
+	}
+	l.ll.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	return true
+}
+
+type memoryStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{lru: newLRU(maxSize)}
+}
+
+func (s *memoryStore) get(key string, req *http.Request) *variant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, found := s.lru.get(key)
+	if !found {
+		return nil
+	}
+	return item.entry.match(req)
+}
+
+func (s *memoryStore) add(key string, v *variant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := &entry{Key: key}
+	if item, found := s.lru.get(key); found {
+		e.Variants = append(e.Variants, item.entry.Variants...)
+	}
+	e.put(v)
+	s.lru.set(&lruItem{key: key, size: e.size(), entry: e})
+}
+
+func (s *memoryStore) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.remove(key)
+}
+
+// diskStore writes one gob file per key and keeps only the sizes in memory.
+// Files left by a previous run are picked up on start.
+type diskStore struct {
+	mu  sync.Mutex
+	dir string
+	lru *lru
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	s := &diskStore{dir: dir, lru: newLRU(maxSize)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.cache"))
+	if err != nil {
+		return nil, err
+	}
+
+	type stored struct {
+		path string
+		key  string
+		size int64
+		mod  int64
+	}
+	var entries []stored
+	for _, path := range files {
+		e, err := readEntry(path)
+		if err != nil {
+			_ = os.Remove(path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, stored{path: path, key: e.Key, size: e.size(), mod: info.ModTime().UnixNano()})
+	}
+
+	// Oldest first, so the most recently written end up most recently used.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mod < entries[j].mod })
+	for _, e := range entries {
+		for _, key := range s.lru.set(&lruItem{key: e.key, size: e.size}) {
+			_ = os.Remove(s.path(key))
+		}
+	}
+	return s, nil
+}
+
+func (s *diskStore) get(key string, req *http.Request) *variant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.lru.get(key); !found {
+		return nil
+	}
+	e, err := readEntry(s.path(key))
+	if err != nil {
+		s.lru.remove(key)
+		return nil
+	}
+	return e.match(req)
+}
+
+func (s *diskStore) add(key string, v *variant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := &entry{Key: key}
+	if _, found := s.lru.get(key); found {
+		if old, err := readEntry(s.path(key)); err == nil {
+			e.Variants = old.Variants
+		}
+	}
+	e.put(v)
+
+	if err := writeEntry(s.path(key), e); err != nil {
+		s.lru.remove(key)
+		_ = os.Remove(s.path(key))
+		return
+	}
+	for _, evicted := range s.lru.set(&lruItem{key: key, size: e.size()}) {
+		_ = os.Remove(s.path(evicted))
+	}
+}
+
+func (s *diskStore) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lru.remove(key) {
+		return false
+	}
+	_ = os.Remove(s.path(key))
+	return true
+}
+
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func readEntry(path string) (*entry, error) {
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// writeEntry writes through a temporary file so readers never see a partial
+// entry.
+func writeEntry(path string, e *entry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
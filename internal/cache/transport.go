@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const revalidateTimeout = 30 * time.Second
+
+// transport answers cacheable requests from the cache and stores the
+// responses of the others. Requests without a key pass through.
+type transport struct {
+	cache *Cache
+	base  http.RoundTripper
+}
+
+// Transport wraps base with the cache.
+func (c *Cache) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{cache: c, base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := keyFrom(req.Context())
+	if !ok || req.Header.Get("Upgrade") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res, err := t.base.RoundTrip(req)
+		// A successful unsafe request invalidates what is stored for the URI.
+		if err == nil && res.StatusCode < 400 {
+			t.cache.Purge(key)
+		}
+		return res, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if _, found := reqCC["no-store"]; found || req.Header.Get("Authorization") != "" {
+		return t.fetch(req, key, statusBypass, false)
+	}
+
+	v := t.cache.store.get(key, req)
+	if v == nil {
+		return t.fetch(req, key, statusMiss, true)
+	}
+
+	now := time.Now()
+	age := v.age(now)
+	lifetime, stale := v.freshness(t.cache.staleWhileRevalidate)
+	if _, found := reqCC["no-cache"]; !found {
+		if age < lifetime {
+			return serve(req, v, age, statusHit), nil
+		}
+		if age < lifetime+stale {
+			t.revalidateAsync(req, key, v)
+			return serve(req, v, age, statusStale), nil
+		}
+	}
+
+	return t.revalidate(req, key, v)
+}
+
+// fetch sends req upstream and, when store is set, stores the response once
+// its body has been read to the end.
+func (t *transport) fetch(req *http.Request, key, status string, store bool) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Set(StatusHeader, status)
+
+	if store && storable(req, res) && res.ContentLength <= t.cache.maxEntrySize {
+		res.Body = &recordingBody{ReadCloser: res.Body, limit: t.cache.maxEntrySize, done: func(body []byte) {
+			t.cache.store.add(key, newVariant(req, res, body, time.Now()))
+		}}
+	}
+	return res, nil
+}
+
+// revalidate asks the upstream whether v is still valid. The client's own
+// validators are replaced by the stored ones and answered from the cache.
+func (t *transport) revalidate(req *http.Request, key string, v *variant) (*http.Response, error) {
+	etag, lastModified := v.Header.Get("ETag"), v.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return t.fetch(req, key, statusExpired, true)
+	}
+
+	cond := req.Clone(req.Context())
+	cond.Header.Del("If-None-Match")
+	cond.Header.Del("If-Modified-Since")
+	if etag != "" {
+		cond.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		cond.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	res, err := t.base.RoundTrip(cond)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusNotModified {
+		res.Header.Set(StatusHeader, statusExpired)
+		if storable(req, res) && res.ContentLength <= t.cache.maxEntrySize {
+			res.Body = &recordingBody{ReadCloser: res.Body, limit: t.cache.maxEntrySize, done: func(body []byte) {
+				t.cache.store.add(key, newVariant(req, res, body, time.Now()))
+			}}
+		}
+		return res, nil
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	updated := refresh(v, res)
+	t.cache.store.add(key, updated)
+	return serve(req, updated, updated.age(time.Now()), statusRevalidated), nil
+}
+
+// revalidateAsync refreshes v in the background, detached from the client.
+func (t *transport) revalidateAsync(req *http.Request, key string, v *variant) {
+	if !t.cache.startRevalidation(key) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), revalidateTimeout)
+	bg := req.Clone(ctx)
+	bg.Method = http.MethodGet
+	go func() {
+		defer t.cache.finishRevalidation(key)
+		defer cancel()
+
+		res, err := t.revalidate(bg, key, v)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
+
+// refresh returns a copy of v with the headers of a 304 response merged in.
+func refresh(v *variant, res *http.Response) *variant {
+	updated := *v
+	updated.Header = v.Header.Clone()
+	for k, vs := range res.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		updated.Header[k] = vs
+	}
+	updated.ResponseTime = time.Now()
+	return &updated
+}
+
+// serve builds the response for a stored variant, answering the client's
+// conditional request with 304 when the validators match.
+func serve(req *http.Request, v *variant, age time.Duration, status string) *http.Response {
+	res := &http.Response{
+		Status:     strconv.Itoa(v.Status) + " " + http.StatusText(v.Status),
+		StatusCode: v.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     v.Header.Clone(),
+		Request:    req,
+	}
+	res.Header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	res.Header.Set(StatusHeader, status)
+
+	if v.Status == http.StatusOK && notModified(req, v) {
+		res.StatusCode = http.StatusNotModified
+		res.Status = "304 " + http.StatusText(http.StatusNotModified)
+		res.Header.Del("Content-Length")
+		res.Body = http.NoBody
+		return res
+	}
+
+	res.ContentLength = int64(len(v.Body))
+	if req.Method == http.MethodHead {
+		res.Body = http.NoBody
+	} else {
+		res.Body = io.NopCloser(bytes.NewReader(v.Body))
+	}
+	return res
+}
+
+func notModified(req *http.Request, v *variant) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(v.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(v.Header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// recordingBody copies what is read into a buffer and hands it over once
+// the body was read completely within the limit.
+type recordingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	exceeded bool
+	done     func([]byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.exceeded {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.exceeded = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.exceeded && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefixes parses CIDRs such as "10.0.0.0/8". A bare address is treated
+// as a single-host prefix.
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("CIDR is invalid value: %s", v)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("CIDR is invalid value: %s", v)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// ParseAddr parses the address part of "host:port" or a bare address.
+func ParseAddr(remoteAddr string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// Contains reports whether the address is inside any of the prefixes.
+func Contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrusted reports whether the peer in remoteAddr is one of the trusted proxies.
+func IsTrusted(remoteAddr string, trusted []netip.Prefix) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+
+	addr, err := ParseAddr(remoteAddr)
+	if err != nil {
+		return false
+	}
+	return Contains(trusted, addr)
+}
+
+// FromRequest returns the client address. When the peer is a trusted proxy,
+// X-Forwarded-For is walked from the right and the first address that isn't
+// a trusted proxy is the client.
+func FromRequest(r *http.Request, trusted []netip.Prefix) (netip.Addr, error) {
+	addr, err := ParseAddr(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !Contains(trusted, addr) {
+		return addr, nil
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !Contains(trusted, hop) {
+			break
+		}
+	}
+	return addr, nil
+}
@@ -0,0 +1,75 @@
+package clientip_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+func TestIsTrusted(t *testing.T) {
+	trusted, err := clientip.ParsePrefixes([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		wont       bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"192.168.1.1:80", true},
+		{"192.168.1.2:80", false},
+		{"[2001:db8::1]:443", true},
+		{"[::ffff:10.0.0.1]:443", true},
+		{"invalid", false},
+	}
+
+	for _, tt := range tests {
+		if got := clientip.IsTrusted(tt.remoteAddr, trusted); got != tt.wont {
+			t.Errorf("%s: got: %v, wont: %v", tt.remoteAddr, got, tt.wont)
+		}
+	}
+}
+
+func TestParsePrefixes_Invalid(t *testing.T) {
+	if _, err := clientip.ParsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	trusted, err := clientip.ParsePrefixes([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		wont       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+
+		got, err := clientip.FromRequest(r, trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tt.wont {
+			t.Errorf("%s %s: got: %s, wont: %s", tt.remoteAddr, tt.xff, got, tt.wont)
+		}
+	}
+}
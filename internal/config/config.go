@@ -1,16 +1,32 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
 	"net/http/httputil"
-	"net/url"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/pelletier/go-toml/v2"
+	"github.com/y-yagi/niwa/internal/auth"
+	"github.com/y-yagi/niwa/internal/cache"
+	"github.com/y-yagi/niwa/internal/clientip"
+	"github.com/y-yagi/niwa/internal/fastcgi"
+	"github.com/y-yagi/niwa/internal/ipfilter"
+	"github.com/y-yagi/niwa/internal/limit"
 	"github.com/y-yagi/niwa/internal/logging"
+	"github.com/y-yagi/niwa/internal/mtls"
+	"github.com/y-yagi/niwa/internal/proxy"
+	"github.com/y-yagi/niwa/internal/ratelimit"
+	"github.com/y-yagi/niwa/internal/secheaders"
+	"github.com/y-yagi/niwa/internal/tlsconfig"
 )
 
 type Config struct {
@@ -18,27 +34,126 @@ type Config struct {
 	RuleMap            map[string]string
 	RoutingMap         map[string]Routing
 	ReverseProxy       *httputil.ReverseProxy
-	Logging            *logging.Logging
+	Logging            logging.Loggings
+	ErrorLogging       *logging.ErrorLogging
+	HTTPCache          *cache.Cache
+	RateLimiter        *ratelimit.Limiter
+	StaticRateLimiter  *ratelimit.Limiter
+	StaticBasicAuth    *auth.BasicAuth
+	IPFilter           *ipfilter.Filter
+	StaticIPFilter     *ipfilter.Filter
+	AdminBasicAuth     *auth.BasicAuth
+	AdminIPFilter      *ipfilter.Filter
+	TrustedProxies     []netip.Prefix
+	ProxyProtocolFrom  []netip.Prefix
+	ClientCAs          *x509.CertPool
+	ClientAuthType     tls.ClientAuthType
+	ClientCertVerifier *mtls.Verifier
+	TLS                tlsconfig.TLSConfig
+	SecurityHeaders    *secheaders.SecurityHeaders
 	RequestBodyMaxSize uint64
 	Timelimit          time.Duration
+	StreamIdleTimeout  time.Duration
 	Port               string
 }
 
 type ConfigFile struct {
-	Root                  string    `toml:"root"`
-	Porti                 int       `toml:"port"`
-	Host                  string    `toml:"host"`
-	Certfile              string    `toml:"certfile"`
-	Keyfile               string    `toml:"keyfile"`
-	Rules                 []Rule    `toml:"rules"`
-	ReverseProxyURL       string    `toml:"reverse_proxy"`
-	Headers               []Header  `toml:"headers"`
-	Routings              []Routing `toml:"routings"`
-	Log                   Log       `toml:"log"`
-	RequestBodyMaxSizeStr string    `toml:"request_body_max_size"`
-	TimelimitStr          string    `toml:"timelimit"`
-	PidFile               string    `toml:"pid_file"`
-	UseHttp3              bool      `toml:"use_http3"`
+	Root                  string      `toml:"root"`
+	Porti                 int         `toml:"port"`
+	Host                  string      `toml:"host"`
+	Certfile              string      `toml:"certfile"`
+	Keyfile               string      `toml:"keyfile"`
+	Rules                 []Rule      `toml:"rules"`
+	ReverseProxyURL       string      `toml:"reverse_proxy"`
+	Headers               []Header    `toml:"headers"`
+	Routings              []Routing   `toml:"routings"`
+	Log                   Log         `toml:"log"`
+	Logs                  []Log       `toml:"logs"`
+	ErrorLog              ErrorLog    `toml:"error_log"`
+	RequestBodyMaxSizeStr string      `toml:"request_body_max_size"`
+	TimelimitStr          string      `toml:"timelimit"`
+	StreamIdleTimeoutStr  string      `toml:"stream_idle_timeout"`
+	PidFile               string      `toml:"pid_file"`
+	UseHttp3              bool        `toml:"use_http3"`
+	TrustedProxiesStr     []string    `toml:"trusted_proxies"`
+	ErrorPages            []ErrorPage `toml:"error_pages"`
+	Cache                 Cache       `toml:"cache"`
+	AdminAddress          string      `toml:"admin_address"`
+	AdminAllow            []string    `toml:"admin_allow"`
+	AdminAuthBasic        AuthBasic   `toml:"admin_auth_basic"`
+	RateLimit             RateLimit   `toml:"rate_limit"`
+	Static                Static      `toml:"static"`
+	MaxConnections        int         `toml:"max_connections"`
+	Allow                 []string    `toml:"allow"`
+	Deny                  []string    `toml:"deny"`
+	ProxyProtocol         bool        `toml:"proxy_protocol"`
+	ProxyProtocolTrusted  []string    `toml:"proxy_protocol_trusted"`
+	ClientCA              string      `toml:"client_ca"`
+	ClientAuth            string      `toml:"client_auth"`
+	TLSMinVersion         string      `toml:"tls_min_version"`
+	TLSCipherSuites       []string    `toml:"tls_cipher_suites"`
+	TLSCurves             []string    `toml:"tls_curves"`
+	TLSALPN               []string    `toml:"tls_alpn"`
+	TLSSessionTicketKeys  string      `toml:"tls_session_ticket_key_file"`
+	TLSOCSPStaple         string      `toml:"tls_ocsp_staple_file"`
+	SecurityHeadersPreset string      `toml:"security_headers"`
+	CSPNonce              bool        `toml:"csp_nonce"`
+	// SecurityHeaderOverrides replace preset values; "" removes a header.
+	SecurityHeaderOverrides map[string]string `toml:"security_header_overrides"`
+}
+
+// Static configures the static files served under /public/.
+type Static struct {
+	RateLimit RateLimit `toml:"rate_limit"`
+	AuthBasic AuthBasic `toml:"auth_basic"`
+	Allow     []string  `toml:"allow"`
+	Deny      []string  `toml:"deny"`
+}
+
+type AuthBasic struct {
+	Realm string `toml:"realm"`
+	File  string `toml:"file"`
+}
+
+type AuthForward struct {
+	URL             string   `toml:"url"`
+	ResponseHeaders []string `toml:"response_headers"`
+	LoginURL        string   `toml:"login_url"`
+	TimeoutStr      string   `toml:"timeout"`
+}
+
+type AuthJWT struct {
+	Realm           string            `toml:"realm"`
+	Issuer          string            `toml:"issuer"`
+	Audience        []string          `toml:"audience"`
+	Algorithms      []string          `toml:"algorithms"`
+	KeyFile         string            `toml:"key_file"`
+	ClaimHeaders    map[string]string `toml:"claim_headers"`
+	LeewayStr       string            `toml:"leeway"`
+	AllowMissingExp bool              `toml:"allow_missing_exp"`
+}
+
+// ClientCert requires a verified TLS client certificate for a routing.
+type ClientCert struct {
+	Required    bool     `toml:"required"`
+	CommonNames []string `toml:"common_names"`
+	SANs        []string `toml:"sans"`
+}
+
+type RateLimit struct {
+	Requests int    `toml:"requests"`
+	PerStr   string `toml:"per"`
+	Burst    int    `toml:"burst"`
+	Key      string `toml:"key"`
+	MaxKeys  int    `toml:"max_keys"`
+}
+
+type Cache struct {
+	Store                   string `toml:"store"`
+	Path                    string `toml:"path"`
+	MaxSizeStr              string `toml:"max_size"`
+	MaxEntrySizeStr         string `toml:"max_entry_size"`
+	StaleWhileRevalidateStr string `toml:"stale_while_revalidate"`
 }
 
 type Rule struct {
@@ -56,13 +171,149 @@ type Log struct {
 	Format string `toml:"format"`
 	File   File   `toml:"file"`
 	Escape string `toml:"escape"`
+	Syslog Syslog `toml:"syslog"`
+
+	Async            bool   `toml:"async"`
+	BufferSize       int    `toml:"buffer_size"`
+	FlushIntervalStr string `toml:"flush_interval"`
+	Overflow         string `toml:"overflow"`
+
+	Skip []LogSkip `toml:"skip"`
+	// SampleRate is the fraction of 2xx responses to log. Unset logs all of
+	// them and 0 logs none.
+	SampleRate *float64 `toml:"sample_rate"`
+}
+
+type LogSkip struct {
+	Paths      []string `toml:"paths"`
+	Statuses   []string `toml:"statuses"`
+	UserAgents []string `toml:"user_agents"`
+	Expr       string   `toml:"expr"`
+}
+
+type Syslog struct {
+	Address  string `toml:"address"`
+	Facility string `toml:"facility"`
+	Tag      string `toml:"tag"`
+}
+
+type ErrorLog struct {
+	Output string `toml:"output"`
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+	File   File   `toml:"file"`
 }
 
 type Routing struct {
-	Path            string `toml:"path"`
-	ReverseProxyURL string `toml:"reverse_proxy"`
-	ReverseProxy    *httputil.ReverseProxy
-	Headers         []Header `toml:"headers"`
+	Path             string `toml:"path"`
+	ReverseProxyURL  string `toml:"reverse_proxy"`
+	ReverseProxy     *httputil.ReverseProxy
+	Headers          []Header `toml:"headers"`
+	Logs             []Log    `toml:"logs"`
+	Logging          logging.Loggings
+	PreserveHost     *bool       `toml:"preserve_host"`
+	RequestHeaders   HeaderRules `toml:"request_headers"`
+	ResponseHeaders  HeaderRules `toml:"response_headers"`
+	StripPrefix      string      `toml:"strip_prefix"`
+	AddPrefix        string      `toml:"add_prefix"`
+	Rewrites         []Rewrite   `toml:"rewrite"`
+	Upstreams        []string    `toml:"upstreams"`
+	Retry            Retry       `toml:"retry"`
+	ErrorPages       []ErrorPage `toml:"error_pages"`
+	Transport        Transport   `toml:"transport"`
+	Streaming        bool        `toml:"streaming"`
+	FlushIntervalStr string      `toml:"flush_interval"`
+	Cache            bool        `toml:"cache"`
+	Coalesce         Coalesce    `toml:"coalesce"`
+	RateLimit        RateLimit   `toml:"rate_limit"`
+	MaxInflight      int         `toml:"max_inflight"`
+	MaxQueue         int         `toml:"max_queue"`
+	QueueTimeoutStr  string      `toml:"queue_timeout"`
+	AuthBasic        AuthBasic   `toml:"auth_basic"`
+	AuthForward      AuthForward `toml:"auth_forward"`
+	AuthJWT          AuthJWT     `toml:"auth_jwt"`
+	Allow            []string    `toml:"allow"`
+	Deny             []string    `toml:"deny"`
+	ClientCert       ClientCert  `toml:"client_cert"`
+	FastCGI          FastCGI     `toml:"fastcgi"`
+	FastCGIHandler   *fastcgi.Handler
+	RateLimiter      *ratelimit.Limiter
+	InflightLimiter  *limit.Inflight
+	BasicAuth        *auth.BasicAuth
+	ForwardAuth      *auth.ForwardAuth
+	JWT              *auth.JWT
+	IPFilter         *ipfilter.Filter
+	ClientCertReq    *mtls.Requirement
+}
+
+type Coalesce struct {
+	Enabled      bool     `toml:"enabled"`
+	Headers      []string `toml:"headers"`
+	MaxBufferStr string   `toml:"max_buffer"`
+}
+
+type FastCGI struct {
+	Address        string            `toml:"address"`
+	Root           string            `toml:"root"`
+	Index          string            `toml:"index"`
+	SplitPath      []string          `toml:"split_path"`
+	Params         map[string]string `toml:"params"`
+	DialTimeoutStr string            `toml:"dial_timeout"`
+}
+
+type Transport struct {
+	MaxIdleConns             int    `toml:"max_idle_conns"`
+	MaxIdleConnsPerHost      int    `toml:"max_idle_conns_per_host"`
+	IdleConnTimeoutStr       string `toml:"idle_conn_timeout"`
+	DialTimeoutStr           string `toml:"dial_timeout"`
+	KeepAliveStr             string `toml:"keepalive"`
+	ResponseHeaderTimeoutStr string `toml:"response_header_timeout"`
+	// HTTP2 defaults to true; false keeps TLS upstreams on HTTP/1.1.
+	HTTP2 *bool        `toml:"http2"`
+	H2C   bool         `toml:"h2c"`
+	TLS   TransportTLS `toml:"tls"`
+}
+
+type TransportTLS struct {
+	CAFile             string `toml:"ca_file"`
+	CertFile           string `toml:"cert_file"`
+	KeyFile            string `toml:"key_file"`
+	ServerName         string `toml:"server_name"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+}
+
+type ErrorPage struct {
+	Statuses []int  `toml:"statuses"`
+	Path     string `toml:"path"`
+	Template bool   `toml:"template"`
+}
+
+type Retry struct {
+	MaxAttempts      int      `toml:"max_attempts"`
+	Statuses         []int    `toml:"statuses"`
+	Errors           []string `toml:"errors"`
+	BackoffStr       string   `toml:"backoff"`
+	PerTryTimeoutStr string   `toml:"per_try_timeout"`
+	MaxBodyBufferStr string   `toml:"max_body_buffer"`
+	NonIdempotent    bool     `toml:"non_idempotent"`
+}
+
+type Rewrite struct {
+	Regex       string `toml:"regex"`
+	Replacement string `toml:"replacement"`
+}
+
+type HeaderRules struct {
+	Set     []Header        `toml:"set"`
+	Add     []Header        `toml:"add"`
+	Remove  []string        `toml:"remove"`
+	Replace []HeaderReplace `toml:"replace"`
+}
+
+type HeaderReplace struct {
+	Key string `toml:"key"`
+	Old string `toml:"old"`
+	New string `toml:"new"`
 }
 
 type File struct {
@@ -92,26 +343,219 @@ func ParseConfigfile(filename string) (*Config, error) {
 		cfg.RuleMap[rule.From] = rule.To
 	}
 
+	errorlogconfig := logging.ErrorLogConfig{Output: cfg.ErrorLog.Output, Level: cfg.ErrorLog.Level, Format: cfg.ErrorLog.Format, FilePath: cfg.ErrorLog.File.Path}
+	if cfg.ErrorLogging, err = logging.NewErrorLogging(&errorlogconfig); err != nil {
+		return nil, err
+	}
+
+	if cfg.TrustedProxies, err = clientip.ParsePrefixes(cfg.TrustedProxiesStr); err != nil {
+		return nil, err
+	}
+
+	if cfg.ProxyProtocol && cfg.UseHttp3 {
+		return nil, errors.New("proxy_protocol is not supported with use_http3")
+	}
+	if cfg.ProxyProtocolFrom, err = clientip.ParsePrefixes(cfg.ProxyProtocolTrusted); err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol && len(cfg.ProxyProtocolFrom) == 0 {
+		return nil, errors.New("proxy_protocol requires proxy_protocol_trusted")
+	}
+
+	if cfg.TLS, err = buildTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.SecurityHeadersPreset != "" || len(cfg.SecurityHeaderOverrides) != 0 || cfg.CSPNonce {
+		shconfig := secheaders.SecurityHeadersConfig{Preset: cfg.SecurityHeadersPreset, Overrides: cfg.SecurityHeaderOverrides, CSPNonce: cfg.CSPNonce}
+		if cfg.SecurityHeaders, err = secheaders.New(&shconfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ClientCA != "" {
+		if len(cfg.Certfile) == 0 || len(cfg.Keyfile) == 0 {
+			return nil, errors.New("client_ca needs certfile and keyfile")
+		}
+		if cfg.ClientCAs, err = mtls.LoadCertPool(cfg.ClientCA); err != nil {
+			return nil, err
+		}
+		if cfg.ClientAuthType, err = mtls.ParseClientAuth(cfg.ClientAuth); err != nil {
+			return nil, err
+		}
+		cfg.ClientCertVerifier = mtls.NewVerifier(cfg.ClientCAs)
+	} else if cfg.ClientAuth != "" {
+		return nil, errors.New("client_auth needs client_ca")
+	}
+
+	if cfg.RateLimiter, err = buildRateLimiter(cfg.RateLimit, cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.StaticRateLimiter, err = buildRateLimiter(cfg.Static.RateLimit, cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.StaticBasicAuth, err = buildBasicAuth(cfg.Static.AuthBasic); err != nil {
+		return nil, err
+	}
+	if cfg.IPFilter, err = buildIPFilter(cfg.Allow, cfg.Deny, cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.StaticIPFilter, err = buildIPFilter(cfg.Static.Allow, cfg.Static.Deny, cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.AdminBasicAuth, err = buildBasicAuth(cfg.AdminAuthBasic); err != nil {
+		return nil, err
+	}
+	// The admin listener isn't behind a proxy, so the peer address is used.
+	if cfg.AdminIPFilter, err = buildIPFilter(cfg.AdminAllow, nil, nil); err != nil {
+		return nil, err
+	}
+	if cfg.AdminAddress != "" {
+		if cfg.AdminAddress, err = adminAddress(cfg.AdminAddress, cfg.AdminBasicAuth != nil || cfg.AdminIPFilter != nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Cache != (Cache{}) {
+		if cfg.HTTPCache, err = buildCache(cfg.Cache); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.ReverseProxyURL != "" {
-		url, err := url.Parse(cfg.ReverseProxyURL)
-		if err != nil {
+		proxyconfig := proxy.ProxyConfig{URL: cfg.ReverseProxyURL, PreserveHost: true, TrustedProxies: cfg.TrustedProxies, ErrorLog: cfg.ErrorLogging.StdLogger(), ErrorPages: buildErrorPages(cfg.ErrorPages)}
+		if cfg.ReverseProxy, err = proxy.New(&proxyconfig); err != nil {
 			return nil, err
 		}
-		cfg.ReverseProxy = httputil.NewSingleHostReverseProxy(url)
 	}
 
-	logconfig := logging.LogConfig{Output: cfg.Log.Output, Format: cfg.Log.Format, FilePath: cfg.Log.File.Path}
-	if cfg.Logging, err = logging.New(&logconfig); err != nil {
+	logs := cfg.Logs
+	if len(logs) == 0 {
+		logs = []Log{cfg.Log}
+	} else if !reflect.ValueOf(cfg.Log).IsZero() {
+		return nil, errors.New("log and logs cannot be used together; move [log] into [[logs]]")
+	}
+	if cfg.Logging, err = buildLoggings(logs, cfg.ErrorLogging); err != nil {
 		return nil, err
 	}
 
 	for _, routing := range cfg.Routings {
-		if len(routing.ReverseProxyURL) != 0 {
-			url, err := url.Parse(routing.ReverseProxyURL)
-			if err != nil {
+		if (len(routing.ReverseProxyURL) != 0 || len(routing.Upstreams) != 0) && len(routing.FastCGI.Address) != 0 {
+			return nil, errors.New("reverse_proxy and fastcgi cannot be used together: " + routing.Path)
+		}
+
+		if len(routing.ReverseProxyURL) != 0 || len(routing.Upstreams) != 0 {
+			proxyconfig := proxy.ProxyConfig{
+				URL:             routing.ReverseProxyURL,
+				PreserveHost:    routing.PreserveHost == nil || *routing.PreserveHost,
+				TrustedProxies:  cfg.TrustedProxies,
+				ErrorLog:        cfg.ErrorLogging.StdLogger(),
+				RequestHeaders:  buildHeaderRules(routing.RequestHeaders),
+				ResponseHeaders: buildHeaderRules(routing.ResponseHeaders),
+				StripPrefix:     routing.StripPrefix,
+				AddPrefix:       routing.AddPrefix,
+				Upstreams:       routing.Upstreams,
+				ErrorPages:      buildErrorPages(cfg.ErrorPages, routing.ErrorPages),
+				Coalesce:        proxy.CoalesceConfig{Enabled: routing.Coalesce.Enabled, Headers: routing.Coalesce.Headers},
+			}
+			if routing.Coalesce.MaxBufferStr != "" {
+				size, err := humanize.ParseBytes(routing.Coalesce.MaxBufferStr)
+				if err != nil {
+					return nil, err
+				}
+				proxyconfig.Coalesce.MaxBuffer = int64(size)
+			}
+			if routing.Cache {
+				// Without a [cache] table, routings share an in-memory cache with the defaults.
+				if cfg.HTTPCache == nil {
+					if cfg.HTTPCache, err = buildCache(cfg.Cache); err != nil {
+						return nil, err
+					}
+				}
+				proxyconfig.Cache = cfg.HTTPCache
+			}
+			if proxyconfig.Retry, err = buildRetryPolicy(routing.Retry); err != nil {
+				return nil, err
+			}
+			if proxyconfig.TransportConfig, err = buildTransportConfig(routing.Transport); err != nil {
+				return nil, err
+			}
+			if routing.FlushIntervalStr != "" {
+				if proxyconfig.FlushInterval, err = time.ParseDuration(routing.FlushIntervalStr); err != nil {
+					return nil, err
+				}
+			}
+			for _, r := range routing.Rewrites {
+				proxyconfig.Rewrites = append(proxyconfig.Rewrites, proxy.PathRewrite{Regex: r.Regex, Replacement: r.Replacement})
+			}
+			if routing.ReverseProxy, err = proxy.New(&proxyconfig); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(routing.FastCGI.Address) != 0 {
+			fcgiconfig := fastcgi.FastCGIConfig{
+				Address:   routing.FastCGI.Address,
+				Root:      routing.FastCGI.Root,
+				Index:     routing.FastCGI.Index,
+				SplitPath: routing.FastCGI.SplitPath,
+				Params:    routing.FastCGI.Params,
+				ErrorLog:  cfg.ErrorLogging.StdLogger(),
+			}
+			if routing.FastCGI.DialTimeoutStr != "" {
+				if fcgiconfig.DialTimeout, err = time.ParseDuration(routing.FastCGI.DialTimeoutStr); err != nil {
+					return nil, err
+				}
+			}
+			if routing.FastCGIHandler, err = fastcgi.New(&fcgiconfig); err != nil {
+				return nil, err
+			}
+		}
+
+		if routing.IPFilter, err = buildIPFilter(routing.Allow, routing.Deny, cfg.TrustedProxies); err != nil {
+			return nil, err
+		}
+
+		if routing.ClientCert.Required || len(routing.ClientCert.CommonNames) != 0 || len(routing.ClientCert.SANs) != 0 {
+			if cfg.ClientCertVerifier == nil {
+				return nil, errors.New("client_cert needs client_ca: " + routing.Path)
+			}
+			routing.ClientCertReq = mtls.NewRequirement(&mtls.RequirementConfig{CommonNames: routing.ClientCert.CommonNames, SANs: routing.ClientCert.SANs})
+		}
+
+		if routing.RateLimiter, err = buildRateLimiter(routing.RateLimit, cfg.TrustedProxies); err != nil {
+			return nil, err
+		}
+
+		if routing.BasicAuth, err = buildBasicAuth(routing.AuthBasic); err != nil {
+			return nil, err
+		}
+
+		if routing.JWT, err = buildJWT(routing.AuthJWT); err != nil {
+			return nil, err
+		}
+
+		if routing.ForwardAuth, err = buildForwardAuth(routing.AuthForward, cfg); err != nil {
+			return nil, err
+		}
+
+		if routing.MaxInflight != 0 {
+			ifconfig := limit.InflightConfig{MaxInflight: routing.MaxInflight, MaxQueue: routing.MaxQueue}
+			if routing.QueueTimeoutStr != "" {
+				if ifconfig.QueueTimeout, err = time.ParseDuration(routing.QueueTimeoutStr); err != nil {
+					return nil, err
+				}
+			}
+			if routing.InflightLimiter, err = limit.NewInflight(&ifconfig); err != nil {
+				return nil, err
+			}
+		}
+
+		routing.Logging = cfg.Logging
+		if len(routing.Logs) != 0 {
+			if routing.Logging, err = buildLoggings(routing.Logs, cfg.ErrorLogging); err != nil {
 				return nil, err
 			}
-			routing.ReverseProxy = httputil.NewSingleHostReverseProxy(url)
 		}
 		cfg.RoutingMap[routing.Path] = routing
 	}
@@ -128,9 +572,333 @@ func ParseConfigfile(filename string) (*Config, error) {
 		}
 	}
 
+	if cfg.StreamIdleTimeoutStr != "" {
+		if cfg.StreamIdleTimeout, err = time.ParseDuration(cfg.StreamIdleTimeoutStr); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.Porti != 0 {
 		cfg.Port = strconv.Itoa(cfg.Porti)
 	}
 
 	return cfg, nil
 }
+
+// Loggings returns every access log built from the config, including the
+// per-routing ones, so they can be reopened and closed together.
+func (cfg *Config) Loggings() logging.Loggings {
+	loggings := append(logging.Loggings{}, cfg.Logging...)
+	for _, routing := range cfg.RoutingMap {
+		if len(routing.Logs) != 0 {
+			loggings = append(loggings, routing.Logging...)
+		}
+	}
+	return loggings
+}
+
+// ReloadCredentials reads the htpasswd and JWT key files again. Each file
+// keeps its current users or keys when it can't be read.
+func (cfg *Config) ReloadCredentials() error {
+	var errs []error
+	if cfg.StaticBasicAuth != nil {
+		errs = append(errs, cfg.StaticBasicAuth.Reload())
+	}
+	if cfg.AdminBasicAuth != nil {
+		errs = append(errs, cfg.AdminBasicAuth.Reload())
+	}
+	for _, routing := range cfg.RoutingMap {
+		if routing.BasicAuth != nil {
+			errs = append(errs, routing.BasicAuth.Reload())
+		}
+		if routing.JWT != nil {
+			errs = append(errs, routing.JWT.Reload())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func buildLoggings(logs []Log, errorLogging *logging.ErrorLogging) (logging.Loggings, error) {
+	var loggings logging.Loggings
+	for _, log := range logs {
+		l, err := buildLogging(log, errorLogging)
+		if err != nil {
+			return nil, err
+		}
+		loggings = append(loggings, l)
+	}
+	return loggings, nil
+}
+
+func buildLogging(log Log, errorLogging *logging.ErrorLogging) (*logging.Logging, error) {
+	var err error
+	logconfig := logging.LogConfig{
+		Output:         log.Output,
+		Format:         log.Format,
+		FilePath:       log.File.Path,
+		Escape:         log.Escape,
+		SyslogAddress:  log.Syslog.Address,
+		SyslogFacility: log.Syslog.Facility,
+		SyslogTag:      log.Syslog.Tag,
+		Async:          log.Async,
+		BufferSize:     log.BufferSize,
+		Overflow:       log.Overflow,
+		ErrorLogging:   errorLogging,
+		SampleRate:     log.SampleRate,
+	}
+	for _, skip := range log.Skip {
+		logconfig.Skip = append(logconfig.Skip, logging.SkipRule{Paths: skip.Paths, Statuses: skip.Statuses, UserAgents: skip.UserAgents, Expr: skip.Expr})
+	}
+	if log.FlushIntervalStr != "" {
+		if logconfig.FlushInterval, err = time.ParseDuration(log.FlushIntervalStr); err != nil {
+			return nil, err
+		}
+	}
+	return logging.New(&logconfig)
+}
+
+func buildHeaderRules(rules HeaderRules) proxy.HeaderRules {
+	hr := proxy.HeaderRules{Remove: rules.Remove}
+	for _, h := range rules.Set {
+		hr.Set = append(hr.Set, proxy.HeaderValue{Key: h.Key, Value: h.Value})
+	}
+	for _, h := range rules.Add {
+		hr.Add = append(hr.Add, proxy.HeaderValue{Key: h.Key, Value: h.Value})
+	}
+	for _, r := range rules.Replace {
+		hr.Replace = append(hr.Replace, proxy.HeaderReplace{Key: r.Key, Old: r.Old, New: r.New})
+	}
+	return hr
+}
+
+func buildRetryPolicy(retry Retry) (proxy.RetryPolicy, error) {
+	var err error
+	policy := proxy.RetryPolicy{MaxAttempts: retry.MaxAttempts, Statuses: retry.Statuses, Errors: retry.Errors, NonIdempotent: retry.NonIdempotent}
+
+	if retry.BackoffStr != "" {
+		if policy.Backoff, err = time.ParseDuration(retry.BackoffStr); err != nil {
+			return policy, err
+		}
+	}
+
+	if retry.PerTryTimeoutStr != "" {
+		if policy.PerTryTimeout, err = time.ParseDuration(retry.PerTryTimeoutStr); err != nil {
+			return policy, err
+		}
+	}
+
+	if retry.MaxBodyBufferStr != "" {
+		size, err := humanize.ParseBytes(retry.MaxBodyBufferStr)
+		if err != nil {
+			return policy, err
+		}
+		policy.MaxBodyBuffer = int64(size)
+	}
+
+	return policy, nil
+}
+
+// buildErrorPages merges error page lists. Later lists override earlier ones
+// for the same status.
+func buildErrorPages(lists ...[]ErrorPage) map[int]proxy.ErrorPage {
+	pages := map[int]proxy.ErrorPage{}
+	for _, list := range lists {
+		for _, page := range list {
+			for _, status := range page.Statuses {
+				pages[status] = proxy.ErrorPage{Path: page.Path, Template: page.Template}
+			}
+		}
+	}
+	return pages
+}
+
+func buildCache(c Cache) (*cache.Cache, error) {
+	cacheconfig := cache.CacheConfig{Store: c.Store, Path: c.Path}
+
+	if c.MaxSizeStr != "" {
+		size, err := humanize.ParseBytes(c.MaxSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		cacheconfig.MaxSize = int64(size)
+	}
+	if c.MaxEntrySizeStr != "" {
+		size, err := humanize.ParseBytes(c.MaxEntrySizeStr)
+		if err != nil {
+			return nil, err
+		}
+		cacheconfig.MaxEntrySize = int64(size)
+	}
+	if c.StaleWhileRevalidateStr != "" {
+		var err error
+		if cacheconfig.StaleWhileRevalidate, err = time.ParseDuration(c.StaleWhileRevalidateStr); err != nil {
+			return nil, err
+		}
+	}
+
+	return cache.New(&cacheconfig)
+}
+
+// buildBasicAuth returns nil when no htpasswd file is configured.
+func buildBasicAuth(ab AuthBasic) (*auth.BasicAuth, error) {
+	if ab.File == "" {
+		return nil, nil
+	}
+	return auth.NewBasicAuth(&auth.BasicAuthConfig{Realm: ab.Realm, File: ab.File})
+}
+
+// buildJWT returns nil when no key file is configured.
+func buildJWT(aj AuthJWT) (*auth.JWT, error) {
+	if aj.KeyFile == "" {
+		return nil, nil
+	}
+
+	jwtconfig := auth.JWTConfig{
+		Realm:           aj.Realm,
+		Issuer:          aj.Issuer,
+		Audience:        aj.Audience,
+		Algorithms:      aj.Algorithms,
+		KeyFile:         aj.KeyFile,
+		ClaimHeaders:    aj.ClaimHeaders,
+		AllowMissingExp: aj.AllowMissingExp,
+	}
+	if aj.LeewayStr != "" {
+		var err error
+		if jwtconfig.Leeway, err = time.ParseDuration(aj.LeewayStr); err != nil {
+			return nil, err
+		}
+	}
+	return auth.NewJWT(&jwtconfig)
+}
+
+// buildForwardAuth returns nil when no auth service is configured.
+func buildForwardAuth(af AuthForward, cfg *Config) (*auth.ForwardAuth, error) {
+	if af.URL == "" {
+		return nil, nil
+	}
+
+	faconfig := auth.ForwardAuthConfig{
+		URL:             af.URL,
+		ResponseHeaders: af.ResponseHeaders,
+		LoginURL:        af.LoginURL,
+		TrustedProxies:  cfg.TrustedProxies,
+		ErrorLog:        cfg.ErrorLogging.StdLogger(),
+	}
+	if af.TimeoutStr != "" {
+		var err error
+		if faconfig.Timeout, err = time.ParseDuration(af.TimeoutStr); err != nil {
+			return nil, err
+		}
+	}
+	return auth.NewForwardAuth(&faconfig)
+}
+
+// buildTLSConfig parses the tls_* settings. The certificate, keys and OCSP
+// response are read by the server.
+func buildTLSConfig(cfg *Config) (tlsconfig.TLSConfig, error) {
+	tc := tlsconfig.TLSConfig{SessionTicketKeyFile: cfg.TLSSessionTicketKeys, OCSPStapleFile: cfg.TLSOCSPStaple}
+	var err error
+	if tc.MinVersion, err = tlsconfig.ParseVersion(cfg.TLSMinVersion); err != nil {
+		return tc, err
+	}
+	if tc.CipherSuites, err = tlsconfig.ParseCipherSuites(cfg.TLSCipherSuites); err != nil {
+		return tc, err
+	}
+	if tc.CurvePreferences, err = tlsconfig.ParseCurves(cfg.TLSCurves); err != nil {
+		return tc, err
+	}
+	if tc.NextProtos, err = tlsconfig.ParseALPN(cfg.TLSALPN); err != nil {
+		return tc, err
+	}
+	return tc, tc.Validate()
+}
+
+// adminAddress listens on loopback when addr has no host. The admin API can
+// purge the cache, so other addresses need admin_allow or admin_auth_basic.
+func adminAddress(addr string, protected bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.New("admin_address is invalid value: " + addr)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip, err := netip.ParseAddr(host); (err == nil && ip.IsLoopback()) || host == "localhost" || protected {
+		return addr, nil
+	}
+	return "", errors.New("admin_address must be a loopback address unless admin_allow or admin_auth_basic is set: " + addr)
+}
+
+// buildIPFilter returns nil when neither list is configured.
+func buildIPFilter(allow, deny []string, trustedProxies []netip.Prefix) (*ipfilter.Filter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	ipconfig := ipfilter.IPFilterConfig{TrustedProxies: trustedProxies}
+	var err error
+	if ipconfig.Allow, err = clientip.ParsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if ipconfig.Deny, err = clientip.ParsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return ipfilter.New(&ipconfig)
+}
+
+// buildRateLimiter returns nil when no limit is configured.
+func buildRateLimiter(rl RateLimit, trustedProxies []netip.Prefix) (*ratelimit.Limiter, error) {
+	if rl.Requests == 0 {
+		return nil, nil
+	}
+
+	rlconfig := ratelimit.RateLimitConfig{Requests: rl.Requests, Burst: rl.Burst, Key: rl.Key, MaxKeys: rl.MaxKeys, TrustedProxies: trustedProxies}
+	if rl.PerStr != "" {
+		var err error
+		if rlconfig.Per, err = time.ParseDuration(rl.PerStr); err != nil {
+			return nil, err
+		}
+		if rlconfig.Per <= 0 {
+			return nil, errors.New("rate limit per must be positive: " + rl.PerStr)
+		}
+	}
+	return ratelimit.New(&rlconfig)
+}
+
+func buildTransportConfig(transport Transport) (proxy.TransportConfig, error) {
+	tc := proxy.TransportConfig{
+		MaxIdleConns:        transport.MaxIdleConns,
+		MaxIdleConnsPerHost: transport.MaxIdleConnsPerHost,
+		DisableHTTP2:        transport.HTTP2 != nil && !*transport.HTTP2,
+		H2C:                 transport.H2C,
+		TLS: proxy.TLSConfig{
+			CAFile:             transport.TLS.CAFile,
+			CertFile:           transport.TLS.CertFile,
+			KeyFile:            transport.TLS.KeyFile,
+			ServerName:         transport.TLS.ServerName,
+			InsecureSkipVerify: transport.TLS.InsecureSkipVerify,
+		},
+	}
+
+	durations := []struct {
+		value string
+		dest  *time.Duration
+	}{
+		{transport.IdleConnTimeoutStr, &tc.IdleConnTimeout},
+		{transport.DialTimeoutStr, &tc.DialTimeout},
+		{transport.KeepAliveStr, &tc.KeepAlive},
+		{transport.ResponseHeaderTimeoutStr, &tc.ResponseHeaderTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return tc, err
+		}
+		*d.dest = v
+	}
+
+	return tc, nil
+}
@@ -1,6 +1,13 @@
 package config_test
 
 import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/y-yagi/niwa/internal/config"
@@ -20,10 +27,74 @@ func TestParseConfigFile(t *testing.T) {
 		t.Errorf("Rule map build error: %+v", config.RuleMap)
 	}
 
-	if len(config.RoutingMap) != 1 {
+	if len(config.RoutingMap) != 2 {
 		t.Errorf("Routing map build error: %+v", config.RoutingMap)
 	}
 
+	if config.RateLimiter == nil || config.StaticRateLimiter != nil {
+		t.Errorf("Rate limiter build error")
+	}
+
+	if config.MaxConnections != 1000 || config.RoutingMap["/app"].InflightLimiter == nil {
+		t.Errorf("Connection limits build error")
+	}
+
+	if config.HTTPCache == nil {
+		t.Errorf("Cache build error")
+	}
+
+	if config.RoutingMap["/app"].ForwardAuth == nil || config.RoutingMap["/php"].ForwardAuth != nil {
+		t.Errorf("Forward auth build error")
+	}
+
+	if config.RoutingMap["/php"].JWT == nil || config.RoutingMap["/app"].JWT != nil {
+		t.Errorf("JWT build error")
+	}
+
+	if config.IPFilter == nil || config.StaticIPFilter != nil || config.RoutingMap["/app"].IPFilter == nil || config.RoutingMap["/php"].IPFilter != nil {
+		t.Errorf("IP filter build error")
+	}
+
+	if !config.ProxyProtocol || len(config.ProxyProtocolFrom) != 1 {
+		t.Errorf("PROXY protocol build error: %+v", config.ProxyProtocolFrom)
+	}
+
+	if config.ClientCAs == nil || config.ClientAuthType != tls.VerifyClientCertIfGiven || config.RoutingMap["/app"].ClientCertReq == nil || config.RoutingMap["/php"].ClientCertReq != nil {
+		t.Errorf("Client certificate build error")
+	}
+
+	if config.TLS.MinVersion != tls.VersionTLS13 || len(config.TLS.CurvePreferences) != 2 || len(config.TLS.NextProtos) != 1 || config.TLS.SessionTicketKeyFile != "/etc/niwa/ticket.keys" {
+		t.Errorf("TLS build error: %+v", config.TLS)
+	}
+
+	if config.SecurityHeaders == nil || !config.CSPNonce || len(config.SecurityHeaderOverrides) != 1 {
+		t.Errorf("Security headers build error")
+	}
+
+	if config.RoutingMap["/php"].FastCGIHandler == nil {
+		t.Errorf("FastCGI handler build error")
+	}
+
+	if len(config.Logging) != 2 {
+		t.Errorf("Logging build error: %+v", config.Logging)
+	}
+
+	if len(config.RoutingMap["/app"].Logging) != 1 {
+		t.Errorf("Routing logging build error: %+v", config.RoutingMap["/app"].Logging)
+	}
+
+	if len(config.Loggings()) != 3 {
+		t.Errorf("Loggings build error: %+v", config.Loggings())
+	}
+
+	if len(config.TrustedProxies) != 2 {
+		t.Errorf("Trusted proxies build error: %+v", config.TrustedProxies)
+	}
+
+	if config.ErrorLogging == nil {
+		t.Errorf("Error logging build error")
+	}
+
 	if config.Timelimit != 0 {
 		t.Errorf("timelimit build error: %+v", config.Timelimit)
 	}
@@ -32,3 +103,87 @@ func TestParseConfigFile(t *testing.T) {
 		t.Errorf("port build error: %+v", config.Port)
 	}
 }
+
+func TestParseConfigFile_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		error  string
+	}{
+		{"log and logs", "[log]\noutput = \"stdout\"\n\n[[logs]]\noutput = \"discard\"\n", "log and logs cannot be used together"},
+		{"rate limit per", "[rate_limit]\nrequests = 10\nper = \"0s\"\n", "rate limit per must be positive"},
+		{"rate limit burst", "[rate_limit]\nrequests = 10\nburst = -1\n", "rate limit burst must not be negative"},
+		{"reverse_proxy and fastcgi", "[[routings]]\npath = \"/app\"\nreverse_proxy = \"http://localhost:3000\"\n\n[routings.fastcgi]\naddress = \"unix:/run/php-fpm.sock\"\n", "reverse_proxy and fastcgi cannot be used together"},
+		{"admin_address", "admin_address = \"0.0.0.0:9000\"\n", "admin_address must be a loopback address"},
+		{"proxy_protocol without trusted", "proxy_protocol = true\n", "proxy_protocol requires proxy_protocol_trusted"},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "niwa.toml")
+		if err := os.WriteFile(file, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := config.ParseConfigfile(file)
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s: got: %v, wont: %s", tt.name, err, tt.error)
+		}
+	}
+}
+
+func TestParseConfigFile_PreserveHost(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host)
+	}))
+	defer as.Close()
+
+	file := filepath.Join(t.TempDir(), "niwa.toml")
+	toml := "[[routings]]\npath = \"/default\"\nreverse_proxy = \"" + as.URL + "\"\n\n" +
+		"[[routings]]\npath = \"/upstream\"\nreverse_proxy = \"" + as.URL + "\"\npreserve_host = false\n"
+	if err := os.WriteFile(file, []byte(toml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ParseConfigfile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		wont string
+	}{
+		{"/default", "niwa.test"},
+		{"/upstream", strings.TrimPrefix(as.URL, "http://")},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.RoutingMap[tt.path].ReverseProxy.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test"+tt.path, nil))
+		if got := w.Body.String(); got != tt.wont {
+			t.Errorf("%s: got: %s, wont: %s", tt.path, got, tt.wont)
+		}
+	}
+}
+
+func TestParseConfigFile_AdminAddress(t *testing.T) {
+	tests := []struct {
+		config string
+		wont   string
+	}{
+		{"admin_address = \":9000\"\n", "127.0.0.1:9000"},
+		{"admin_address = \"localhost:9000\"\n", "localhost:9000"},
+		{"admin_address = \"0.0.0.0:9000\"\nadmin_allow = [\"10.0.0.0/8\"]\n", "0.0.0.0:9000"},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "niwa.toml")
+		if err := os.WriteFile(file, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.ParseConfigfile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.AdminAddress != tt.wont {
+			t.Errorf("got: %s, wont: %s", cfg.AdminAddress, tt.wont)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FastCGIConfig struct {
+	// Address is "unix:/path/to.sock", "tcp://host:port" or "host:port".
+	Address     string
+	Root        string
+	Index       string
+	SplitPath   []string
+	Params      map[string]string
+	DialTimeout time.Duration
+	ErrorLog    *log.Logger
+}
+
+// Handler serves requests by passing them to a FastCGI responder such as
+// PHP-FPM.
+type Handler struct {
+	network     string
+	address     string
+	root        string
+	index       string
+	splitPath   []string
+	params      map[string]string
+	dialTimeout time.Duration
+	errorLog    *log.Logger
+}
+
+const (
+	defaultIndex       = "index.php"
+	defaultDialTimeout = 30 * time.Second
+)
+
+var defaultSplitPath = []string{".php"}
+
+func New(fcgiconfig *FastCGIConfig) (*Handler, error) {
+	h := &Handler{
+		root:        fcgiconfig.Root,
+		index:       fcgiconfig.Index,
+		splitPath:   fcgiconfig.SplitPath,
+		params:      fcgiconfig.Params,
+		dialTimeout: fcgiconfig.DialTimeout,
+		errorLog:    fcgiconfig.ErrorLog,
+	}
+
+	switch {
+	case fcgiconfig.Address == "":
+		return nil, errors.New("fastcgi address is missing")
+	case strings.HasPrefix(fcgiconfig.Address, "unix:"):
+		h.network, h.address = "unix", strings.TrimPrefix(fcgiconfig.Address, "unix:")
+	case strings.HasPrefix(fcgiconfig.Address, "tcp://"):
+		h.network, h.address = "tcp", strings.TrimPrefix(fcgiconfig.Address, "tcp://")
+	default:
+		h.network, h.address = "tcp", fcgiconfig.Address
+	}
+
+	if h.index == "" {
+		h.index = defaultIndex
+	}
+	if len(h.splitPath) == 0 {
+		h.splitPath = defaultSplitPath
+	}
+	if h.dialTimeout == 0 {
+		h.dialTimeout = defaultDialTimeout
+	}
+
+	return h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dialer := &net.Dialer{Timeout: h.dialTimeout}
+	conn, err := dialer.DialContext(r.Context(), h.network, h.address)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks reads and writes once the client is gone.
+	stop := context.AfterFunc(r.Context(), func() { _ = conn.Close() })
+	defer stop()
+
+	body, contentLength, err := requestBody(r)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	cw := &recordWriter{w: bufio.NewWriter(conn)}
+	if err := cw.beginRequest(); err != nil {
+		h.fail(w, err)
+		return
+	}
+	if err := cw.writeParams(h.buildParams(r, contentLength)); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	// The body is sent while the response is read, so a responder that
+	// answers before consuming everything doesn't deadlock.
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		if err := cw.writeStream(typeStdin, body); err != nil {
+			_ = conn.Close()
+		}
+	}()
+	// The request body can't be read once ServeHTTP returns, so stop the copy
+	// and wait for it. The read deadline unblocks a read from a slow client.
+	defer func() {
+		select {
+		case <-stdinDone:
+			return
+		default:
+		}
+		_ = conn.Close()
+		_ = http.NewResponseController(w).SetReadDeadline(time.Now())
+		<-stdinDone
+	}()
+
+	pr, pw := io.Pipe()
+	go h.readRecords(conn, pw)
+	defer pr.Close()
+
+	br := bufio.NewReader(pr)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		// net/http panics on codes outside 100-999, and a final response
+		// can't be informational.
+		if status, err = strconv.Atoi(code); err != nil || status < 200 || status > 999 {
+			h.fail(w, fmt.Errorf("invalid status: %s", s))
+			return
+		}
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	delete(header, "Status")
+
+	for k, vs := range header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, br); err != nil {
+		h.logf("fastcgi: response error: %v", err)
+	}
+}
+
+// readRecords forwards STDOUT to pw and logs STDERR until the request ends.
+func (h *Handler) readRecords(conn net.Conn, pw *io.PipeWriter) {
+	br := bufio.NewReader(conn)
+	for {
+		rec, err := readRecord(br)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		switch rec.typ {
+		case typeStdout:
+			if _, err := pw.Write(rec.content); err != nil {
+				return
+			}
+		case typeStderr:
+			if len(rec.content) > 0 {
+				h.logf("fastcgi: %s", strings.TrimSpace(string(rec.content)))
+			}
+		case typeEndRequest:
+			pw.Close()
+			return
+		}
+	}
+}
+
+func (h *Handler) buildParams(r *http.Request, contentLength int64) map[string]string {
+	scriptName, pathInfo := h.splitScript(r.URL.Path)
+
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	scheme, defaultPort := "http", "80"
+	if r.TLS != nil {
+		scheme, defaultPort = "https", "443"
+	}
+	serverName, serverPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		serverName, serverPort = r.Host, defaultPort
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "niwa",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_SCHEME":    scheme,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     h.root,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.Join(h.root, filepath.FromSlash(scriptName)),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+	}
+	if contentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(contentLength, 10)
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(h.root, filepath.FromSlash(pathInfo))
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+
+	for k, vs := range r.Header {
+		// Skip Proxy to avoid httpoxy, and the headers already passed above.
+		if k == "Proxy" || k == "Content-Type" || k == "Content-Length" {
+			continue
+		}
+		params["HTTP_"+strings.ReplaceAll(strings.ToUpper(k), "-", "_")] = strings.Join(vs, ", ")
+	}
+	if r.Host != "" {
+		params["HTTP_HOST"] = r.Host
+	}
+
+	for k, v := range h.params {
+		params[k] = v
+	}
+	return params
+}
+
+// splitScript splits the request path into the script name and the path info
+// after it, e.g. "/index.php/users" into "/index.php" and "/users".
+func (h *Handler) splitScript(p string) (string, string) {
+	dir := strings.HasSuffix(p, "/")
+	p = path.Clean("/" + p)
+	for _, split := range h.splitPath {
+		if i := strings.Index(strings.ToLower(p), strings.ToLower(split)); i >= 0 {
+			end := i + len(split)
+			if end == len(p) || p[end] == '/' {
+				return p[:end], p[end:]
+			}
+		}
+	}
+
+	if dir {
+		return path.Join(p, h.index), ""
+	}
+	return p, ""
+}
+
+func (h *Handler) fail(w http.ResponseWriter, err error) {
+	h.logf("fastcgi: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (h *Handler) logf(format string, args ...any) {
+	if h.errorLog != nil {
+		h.errorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// requestBody returns the body to send as STDIN. FastCGI responders need
+// CONTENT_LENGTH, so a body of unknown length is read into memory first.
+func requestBody(r *http.Request) (io.Reader, int64, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return http.NoBody, 0, nil
+	}
+	if r.ContentLength >= 0 {
+		return r.Body, r.ContentLength, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(body), int64(len(body)), nil
+}
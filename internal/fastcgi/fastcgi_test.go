@@ -0,0 +1,211 @@
+package fastcgi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startResponder(t *testing.T, network, address string, handler http.Handler) string {
+	t.Helper()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() { _ = fcgi.Serve(l, handler) }()
+
+	if network == "unix" {
+		return "unix:" + address
+	}
+	return l.Addr().String()
+}
+
+func TestFastCGI(t *testing.T) {
+	responder := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Script-Filename", env["SCRIPT_FILENAME"])
+		w.Header().Set("X-Path-Info", r.URL.Path)
+		w.Header().Set("X-App-Env", env["APP_ENV"])
+		w.Header().Set("X-Custom", r.Header.Get("X-Custom"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RawQuery, body)
+	})
+
+	tests := map[string]struct {
+		network string
+		address string
+	}{
+		"tcp":  {network: "tcp", address: "127.0.0.1:0"},
+		"unix": {network: "unix", address: filepath.Join(t.TempDir(), "fcgi.sock")},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			address := startResponder(t, tt.network, tt.address, responder)
+			h, err := New(&FastCGIConfig{Address: address, Root: "/var/www", Params: map[string]string{"APP_ENV": "test"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/app/index.php/users?page=2", strings.NewReader("name=niwa"))
+			r.Header.Set("X-Custom", "value")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusCreated {
+				t.Fatalf("expected 201, but got %d", w.Code)
+			}
+			if got := w.Header().Get("X-Script-Filename"); got != "/var/www/app/index.php" {
+				t.Errorf("expected SCRIPT_FILENAME '/var/www/app/index.php', but got '%s'", got)
+			}
+			if got := w.Header().Get("X-App-Env"); got != "test" {
+				t.Errorf("expected APP_ENV 'test', but got '%s'", got)
+			}
+			if got := w.Header().Get("X-Custom"); got != "value" {
+				t.Errorf("expected header 'value', but got '%s'", got)
+			}
+			if got := w.Body.String(); got != "POST page=2 name=niwa" {
+				t.Errorf("expected 'POST page=2 name=niwa', but got '%s'", got)
+			}
+		})
+	}
+}
+
+func TestFastCGI_Index(t *testing.T) {
+	address := startResponder(t, "tcp", "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		_, _ = io.WriteString(w, fcgi.ProcessEnv(r)["SCRIPT_FILENAME"])
+	}))
+
+	h, err := New(&FastCGIConfig{Address: address, Root: "/srv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/blog/", nil))
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected 302, but got %d", w.Code)
+	}
+	if got := w.Header().Get("Location"); got != "/login" {
+		t.Errorf("expected Location '/login', but got '%s'", got)
+	}
+	if got := w.Body.String(); !strings.HasSuffix(got, "/srv/blog/index.php") {
+		t.Errorf("expected SCRIPT_FILENAME '/srv/blog/index.php', but got '%s'", got)
+	}
+}
+
+func TestFastCGI_Unavailable(t *testing.T) {
+	h, err := New(&FastCGIConfig{Address: "unix:" + filepath.Join(t.TempDir(), "missing.sock"), ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/index.php", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, but got %d", w.Code)
+	}
+}
+
+// startRawResponder answers every connection with stdout without reading the
+// request, and keeps the connection open until the test ends.
+func startRawResponder(t *testing.T, stdout string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		l.Close()
+		close(conns)
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			rw := &recordWriter{w: bufio.NewWriter(conn)}
+			_ = rw.writeStream(typeStdout, strings.NewReader(stdout))
+			_ = rw.write(typeEndRequest, make([]byte, 8))
+		}
+	}()
+	return l.Addr().String()
+}
+
+// endlessBody fails the test when it is read after the handler returned.
+type endlessBody struct {
+	t        *testing.T
+	returned atomic.Bool
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.returned.Load() {
+		b.t.Error("request body was read after ServeHTTP returned")
+	}
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	return nil
+}
+
+func TestFastCGI_EarlyResponse(t *testing.T) {
+	h, err := New(&FastCGIConfig{Address: startRawResponder(t, "Status: 413 Payload Too Large\r\n\r\ntoo large")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &endlessBody{t: t}
+	r := httptest.NewRequest(http.MethodPost, "/upload.php", nil)
+	r.Body = body
+	r.ContentLength = 1 << 40
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body.returned.Store(true)
+
+	if w.Code != http.StatusRequestEntityTooLarge || w.Body.String() != "too large" {
+		t.Errorf("got: %d %s, wont: 413 too large", w.Code, w.Body.String())
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestFastCGI_InvalidStatus(t *testing.T) {
+	for _, status := range []string{"1000", "99", "abc"} {
+		h, err := New(&FastCGIConfig{Address: startRawResponder(t, "Status: "+status+"\r\n\r\n"), ErrorLog: log.New(io.Discard, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/index.php", nil))
+
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%s: got: %d, wont: 502", status, w.Code)
+		}
+	}
+}
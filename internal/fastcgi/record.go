@@ -0,0 +1,140 @@
+package fastcgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Record types and constants from the FastCGI specification.
+const (
+	typeBeginRequest uint8 = 1
+	typeEndRequest   uint8 = 3
+	typeParams       uint8 = 4
+	typeStdin        uint8 = 5
+	typeStdout       uint8 = 6
+	typeStderr       uint8 = 7
+
+	roleResponder = 1
+
+	version1      = 1
+	requestID     = 1
+	headerLen     = 8
+	maxContentLen = 65535
+)
+
+type record struct {
+	typ     uint8
+	content []byte
+}
+
+// recordWriter writes the records of a single request. Every request uses
+// its own connection, so the request ID is always 1 and the responder closes
+// the connection when it is done.
+type recordWriter struct {
+	w *bufio.Writer
+}
+
+func (rw *recordWriter) beginRequest() error {
+	body := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+	return rw.write(typeBeginRequest, body)
+}
+
+func (rw *recordWriter) writeParams(params map[string]string) error {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf []byte
+	for _, k := range keys {
+		buf = appendLength(buf, len(k))
+		buf = appendLength(buf, len(params[k]))
+		buf = append(buf, k...)
+		buf = append(buf, params[k]...)
+	}
+
+	if err := rw.writeChunks(typeParams, buf); err != nil {
+		return err
+	}
+	// An empty record ends the stream.
+	return rw.write(typeParams, nil)
+}
+
+// writeStream copies r as a stream of records of typ, ending with an empty one.
+func (rw *recordWriter) writeStream(typ uint8, r io.Reader) error {
+	buf := make([]byte, maxContentLen)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := rw.write(typ, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rw.write(typ, nil)
+}
+
+func (rw *recordWriter) writeChunks(typ uint8, content []byte) error {
+	for len(content) > 0 {
+		n := min(len(content), maxContentLen)
+		if err := rw.write(typ, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return nil
+}
+
+func (rw *recordWriter) write(typ uint8, content []byte) error {
+	padding := -len(content) & 7
+	header := [headerLen]byte{version1, typ, 0, requestID, 0, 0, uint8(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+
+	if _, err := rw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := rw.w.Write(content); err != nil {
+		return err
+	}
+	if _, err := rw.w.Write(make([]byte, padding)); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+func readRecord(r *bufio.Reader) (*record, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != version1 {
+		return nil, fmt.Errorf("unsupported fastcgi version: %d", header[0])
+	}
+
+	contentLen := int(binary.BigEndian.Uint16(header[4:6]))
+	paddingLen := int(header[6])
+	buf := make([]byte, contentLen+paddingLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &record{typ: header[1], content: buf[:contentLen]}, nil
+}
+
+// appendLength encodes a name-value pair length: one byte up to 127, four
+// bytes with the high bit set above that.
+func appendLength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+}
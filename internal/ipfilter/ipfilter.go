@@ -0,0 +1,59 @@
+package ipfilter
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+type IPFilterConfig struct {
+	// Allow, when not empty, is the only addresses let through. Deny is
+	// checked first and always wins.
+	Allow          []netip.Prefix
+	Deny           []netip.Prefix
+	TrustedProxies []netip.Prefix
+}
+
+// Filter allows or denies requests by client IP.
+type Filter struct {
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+func New(ipconfig *IPFilterConfig) (*Filter, error) {
+	if len(ipconfig.Allow) == 0 && len(ipconfig.Deny) == 0 {
+		return nil, errors.New("ip filter needs allow or deny")
+	}
+
+	return &Filter{allow: ipconfig.Allow, deny: ipconfig.Deny, trustedProxies: ipconfig.TrustedProxies}, nil
+}
+
+// Allow reports whether the client may be served. Otherwise it responds with
+// 403 and returns false. A nil Filter allows everything.
+func (f *Filter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.allowed(r) {
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+func (f *Filter) allowed(r *http.Request) bool {
+	addr, err := clientip.FromRequest(r, f.trustedProxies)
+	if err != nil {
+		// A filter is configured, so a client it can't place is denied.
+		return false
+	}
+
+	if clientip.Contains(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || clientip.Contains(f.allow, addr)
+}
@@ -0,0 +1,76 @@
+package ipfilter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/ipfilter"
+)
+
+func TestAllow(t *testing.T) {
+	f, err := ipfilter.New(&ipfilter.IPFilterConfig{
+		Allow:          []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:           []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")},
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		allowed    bool
+	}{
+		{"192.0.2.1:1234", "", true},
+		{"[2001:db8::1]:1234", "", true},
+		{"192.0.2.10:1234", "", false},
+		{"198.51.100.1:1234", "", false},
+		// X-Forwarded-For is only used when the peer is trusted.
+		{"198.51.100.1:1234", "192.0.2.1", false},
+		{"10.0.0.1:1234", "192.0.2.1", true},
+		{"10.0.0.1:1234", "192.0.2.10", false},
+		{"10.0.0.1:1234", "192.0.2.1, 198.51.100.1", false},
+		{"@", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		w := httptest.NewRecorder()
+
+		if got := f.Allow(w, r); got != tt.allowed {
+			t.Errorf("%s %s: got: %v, wont: %v", tt.remoteAddr, tt.xff, got, tt.allowed)
+		}
+		if !tt.allowed && w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got: %d, wont: 403", tt.remoteAddr, tt.xff, w.Code)
+		}
+	}
+}
+
+func TestAllow_DenyOnly(t *testing.T) {
+	f, err := ipfilter.New(&ipfilter.IPFilterConfig{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, allowed := range map[string]bool{"192.0.2.1:1": false, "198.51.100.1:1": true} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		if got := f.Allow(httptest.NewRecorder(), r); got != allowed {
+			t.Errorf("%s: got: %v, wont: %v", addr, got, allowed)
+		}
+	}
+}
+
+func TestAllow_Nil(t *testing.T) {
+	var f *ipfilter.Filter
+	if !f.Allow(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+		t.Error("nil filter denied a request")
+	}
+}
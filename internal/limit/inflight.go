@@ -0,0 +1,87 @@
+package limit
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+type InflightConfig struct {
+	MaxInflight int
+	// MaxQueue requests wait for a slot for up to QueueTimeout. Requests that
+	// find the queue full fail at once.
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+// Inflight limits the requests being served at the same time.
+type Inflight struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func NewInflight(ifconfig *InflightConfig) (*Inflight, error) {
+	if ifconfig.MaxInflight <= 0 {
+		return nil, errors.New("max inflight must be positive")
+	}
+	if ifconfig.MaxQueue < 0 {
+		return nil, errors.New("max queue must not be negative")
+	}
+
+	return &Inflight{
+		slots:   make(chan struct{}, ifconfig.MaxInflight),
+		queue:   make(chan struct{}, ifconfig.MaxQueue),
+		timeout: ifconfig.QueueTimeout,
+	}, nil
+}
+
+// Acquire takes a slot for the request, waiting in the queue if there is
+// room. When no slot is available it responds with 503 and returns false;
+// otherwise the caller must call release when done. A nil Inflight allows
+// everything.
+func (l *Inflight) Acquire(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if l.wait(r) {
+		return release, true
+	}
+
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	return nil, false
+}
+
+func (l *Inflight) wait(r *http.Request) bool {
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-l.queue }()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,197 @@
+package limit_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madflojo/testcerts"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/y-yagi/niwa/internal/limit"
+)
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(limit.RejectHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})))
+	ts.Listener = limit.NewListener(l, 1)
+	ts.Config.ConnContext = limit.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	get := func(conn net.Conn) *http.Response {
+		t.Helper()
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: niwa.test\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// The first connection stays open and takes the only slot.
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := get(first); res.StatusCode != http.StatusOK {
+		t.Fatalf("got: %d, wont: 200", res.StatusCode)
+	}
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if res := get(second); res.StatusCode != http.StatusServiceUnavailable || !res.Close {
+		t.Errorf("got: %d close=%v, wont: 503 close=true", res.StatusCode, res.Close)
+	}
+
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if res := get(third); res.StatusCode != http.StatusOK {
+		t.Errorf("got: %d, wont: 200 after the slot was freed", res.StatusCode)
+	}
+}
+
+func TestListener_QUIC(t *testing.T) {
+	certPEM, keyPEM, err := testcerts.GenerateCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsconf := http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ql, err := quic.ListenAddrEarly("127.0.0.1:0", tlsconf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limit.NewListener(tcp, 1)
+	defer l.Close()
+
+	server := &http3.Server{
+		Handler: limit.RejectHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		})),
+		ConnContext: limit.QUICConnContext,
+	}
+	go func() { _ = server.ServeListener(l.QUIC(ql)) }()
+	defer server.Close()
+
+	get := func(rt *http3.RoundTripper) int {
+		t.Helper()
+		res, err := (&http.Client{Transport: rt}).Get("https://" + ql.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	newRoundTripper := func() *http3.RoundTripper {
+		return &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	// The first connection stays open and takes the only slot.
+	first := newRoundTripper()
+	if got := get(first); got != http.StatusOK {
+		t.Fatalf("got: %d, wont: 200", got)
+	}
+
+	second := newRoundTripper()
+	defer second.Close()
+	if got := get(second); got != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: 503", got)
+	}
+
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	third := newRoundTripper()
+	defer third.Close()
+	if got := get(third); got != http.StatusOK {
+		t.Errorf("got: %d, wont: 200 after the slot was freed", got)
+	}
+}
+
+func TestInflight(t *testing.T) {
+	l, err := limit.NewInflight(&limit.InflightConfig{MaxInflight: 1, MaxQueue: 1, QueueTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquire := func() (func(), int) {
+		w := httptest.NewRecorder()
+		release, ok := l.Acquire(w, httptest.NewRequest("GET", "/", nil))
+		if !ok {
+			return nil, w.Code
+		}
+		return release, http.StatusOK
+	}
+
+	release, status := acquire()
+	if status != http.StatusOK {
+		t.Fatalf("got: %d, wont: 200", status)
+	}
+
+	// The second request waits in the queue and gets the slot once it is
+	// released; the third finds the queue full.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var queued int
+	go func() {
+		defer wg.Done()
+		var r func()
+		r, queued = acquire()
+		if r != nil {
+			r()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if _, status := acquire(); status != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: 503 with a full queue", status)
+	}
+
+	release()
+	wg.Wait()
+	if queued != http.StatusOK {
+		t.Errorf("got: %d, wont: 200 for the queued request", queued)
+	}
+
+	// Without a release, a queued request times out.
+	release, _ = acquire()
+	defer release()
+	start := time.Now()
+	if _, status := acquire(); status != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: 503 after the queue timeout", status)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("got: %v, wont: at least the queue timeout", elapsed)
+	}
+}
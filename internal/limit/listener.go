@@ -0,0 +1,141 @@
+package limit
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Listener allows up to max open connections. Connections over the limit are
+// still accepted, so they can get a quick 503 from RejectHandler instead of
+// waiting in the backlog, and are closed after that response. They are held
+// only as long as the server's read and write timeouts allow.
+type Listener struct {
+	net.Listener
+	max    int64
+	active atomic.Int64
+}
+
+type rejectedConnContextKey struct{}
+
+func NewListener(l net.Listener, max int) *Listener {
+	return &Listener{Listener: l, max: int64(max)}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.acquire() {
+		return &rejectedConn{Conn: c}, nil
+	}
+	return &limitedConn{Conn: c, release: l.release}, nil
+}
+
+func (l *Listener) acquire() bool {
+	if l.active.Add(1) > l.max {
+		l.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *Listener) release() {
+	l.active.Add(-1)
+}
+
+// QUIC wraps an HTTP/3 listener so its connections count against the same
+// limit. Use QUICConnContext as http3.Server.ConnContext.
+func (l *Listener) QUIC(ql http3.QUICEarlyListener) http3.QUICEarlyListener {
+	return &quicListener{QUICEarlyListener: ql, l: l}
+}
+
+type quicListener struct {
+	http3.QUICEarlyListener
+	l *Listener
+}
+
+func (ql *quicListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	c, err := ql.QUICEarlyListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ql.l.acquire() {
+		// HTTP/3 has no Connection: close, so give the client time to read
+		// the 503 and close the connection from here.
+		time.AfterFunc(rejectedQUICTimeout, func() {
+			_ = c.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		})
+		return &rejectedQUICConn{EarlyConnection: c}, nil
+	}
+	context.AfterFunc(c.Context(), ql.l.release)
+	return c, nil
+}
+
+const rejectedQUICTimeout = 10 * time.Second
+
+type rejectedQUICConn struct {
+	quic.EarlyConnection
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+type rejectedConn struct {
+	net.Conn
+}
+
+// ConnContext marks requests on rejected connections. Use it as
+// http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if _, ok := c.(*rejectedConn); ok {
+		return context.WithValue(ctx, rejectedConnContextKey{}, true)
+	}
+	return ctx
+}
+
+// QUICConnContext is ConnContext for http3.Server.
+func QUICConnContext(ctx context.Context, c quic.Connection) context.Context {
+	if _, ok := c.(*rejectedQUICConn); ok {
+		return context.WithValue(ctx, rejectedConnContextKey{}, true)
+	}
+	return ctx
+}
+
+// RejectHandler responds with 503 to requests on connections over the limit
+// and passes the others to next.
+func RejectHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rejected, _ := r.Context().Value(rejectedConnContextKey{}).(bool); rejected {
+			if r.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAsyncBufferSize    = 1024
+	defaultAsyncFlushInterval = time.Second
+)
+
+// asyncWriter moves access log output off the request goroutine. Rendered
+// lines are queued and written in batches by a background goroutine, either
+// every flush interval or when a flush is requested.
+type asyncWriter struct {
+	lines    chan string
+	flushReq chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+	interval time.Duration
+	overflow string
+	output   func([]string)
+	onDrop   func(uint64)
+	pending  []string
+	dropped  atomic.Uint64
+	reported uint64
+}
+
+func newAsyncWriter(logconfig *LogConfig, output func([]string), onDrop func(uint64)) (*asyncWriter, error) {
+	size := logconfig.BufferSize
+	if size == 0 {
+		size = defaultAsyncBufferSize
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("log buffer size is invalid value: %d", size)
+	}
+
+	interval := logconfig.FlushInterval
+	if interval == 0 {
+		interval = defaultAsyncFlushInterval
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("log flush interval is invalid value: %s", interval)
+	}
+
+	switch logconfig.Overflow {
+	case "", "block", "drop", "count":
+	default:
+		return nil, fmt.Errorf("log overflow is invalid value: %s", logconfig.Overflow)
+	}
+
+	a := &asyncWriter{
+		lines:    make(chan string, size),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		interval: interval,
+		overflow: logconfig.Overflow,
+		output:   output,
+		onDrop:   onDrop,
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *asyncWriter) Write(msg string) {
+	if a.overflow == "" || a.overflow == "block" {
+		select {
+		case a.lines <- msg:
+		case <-a.done:
+			a.dropped.Add(1)
+		}
+		return
+	}
+
+	select {
+	case a.lines <- msg:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Flush writes every queued line and returns once they are written.
+func (a *asyncWriter) Flush() {
+	ack := make(chan struct{})
+	select {
+	case a.flushReq <- ack:
+		<-ack
+	case <-a.stopped:
+	}
+}
+
+// Close flushes queued lines and stops the background goroutine.
+func (a *asyncWriter) Close() {
+	a.once.Do(func() { close(a.done) })
+	<-a.stopped
+}
+
+func (a *asyncWriter) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.stopped)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-a.lines:
+			a.pending = append(a.pending, msg)
+			if len(a.pending) >= cap(a.lines) {
+				a.flush()
+			}
+		case <-ticker.C:
+			a.flush()
+			a.reportDrops()
+		case ack := <-a.flushReq:
+			a.drain()
+			a.flush()
+			close(ack)
+		case <-a.done:
+			a.drain()
+			a.flush()
+			a.reportDrops()
+			return
+		}
+	}
+}
+
+func (a *asyncWriter) drain() {
+	for {
+		select {
+		case msg := <-a.lines:
+			a.pending = append(a.pending, msg)
+		default:
+			return
+		}
+	}
+}
+
+func (a *asyncWriter) flush() {
+	if len(a.pending) == 0 {
+		return
+	}
+	a.output(a.pending)
+	a.pending = a.pending[:0]
+}
+
+func (a *asyncWriter) reportDrops() {
+	if a.overflow != "count" || a.onDrop == nil {
+		return
+	}
+
+	total := a.dropped.Load()
+	if total == a.reported {
+		return
+	}
+	a.onDrop(total - a.reported)
+	a.reported = total
+}
@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+type ErrorLogging struct {
+	logger   *slog.Logger
+	writer   *reopenWriter
+	filePath string
+}
+
+// ErrorLogConfig configures the error log. Level defaults to info, so
+// lifecycle events like reloads and shutdowns are logged.
+type ErrorLogConfig struct {
+	Output   string
+	Level    string
+	Format   string
+	FilePath string
+}
+
+type reopenWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+func (rw *reopenWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.w.Write(p)
+}
+
+func NewErrorLogging(errorlogconfig *ErrorLogConfig) (*ErrorLogging, error) {
+	errorlog := &ErrorLogging{filePath: errorlogconfig.FilePath}
+
+	w, f, err := buildErrorLogWriter(errorlogconfig)
+	if err != nil {
+		return nil, err
+	}
+	errorlog.writer = &reopenWriter{w: w, file: f}
+
+	level, err := buildErrorLogLevel(errorlogconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch errorlogconfig.Format {
+	case "", "text":
+		errorlog.logger = slog.New(slog.NewTextHandler(errorlog.writer, opts))
+	case "json":
+		errorlog.logger = slog.New(slog.NewJSONHandler(errorlog.writer, opts))
+	default:
+		return nil, fmt.Errorf("error log format is invalid value: %s", errorlogconfig.Format)
+	}
+
+	return errorlog, nil
+}
+
+// Logger returns the underlying slog.Logger. A nil ErrorLogging falls back to slog.Default.
+func (e *ErrorLogging) Logger() *slog.Logger {
+	if e == nil || e.logger == nil {
+		return slog.Default()
+	}
+	return e.logger
+}
+
+// StdLogger returns a log.Logger that writes to the error log at error level.
+// It is meant for http.Server.ErrorLog and httputil.ReverseProxy.ErrorLog.
+func (e *ErrorLogging) StdLogger() *log.Logger {
+	if e == nil || e.logger == nil {
+		return nil
+	}
+	return slog.NewLogLogger(e.logger.Handler(), slog.LevelError)
+}
+
+func (e *ErrorLogging) Debug(msg string, args ...any) {
+	e.Logger().Debug(msg, args...)
+}
+
+func (e *ErrorLogging) Info(msg string, args ...any) {
+	e.Logger().Info(msg, args...)
+}
+
+func (e *ErrorLogging) Warn(msg string, args ...any) {
+	e.Logger().Warn(msg, args...)
+}
+
+func (e *ErrorLogging) Error(msg string, args ...any) {
+	e.Logger().Error(msg, args...)
+}
+
+func (e *ErrorLogging) Reopen() error {
+	if e == nil || e.writer == nil || e.writer.file == nil {
+		return nil
+	}
+	e.writer.mu.Lock()
+	defer e.writer.mu.Unlock()
+
+	if err := e.writer.file.Sync(); err != nil {
+		return err
+	}
+	if err := e.writer.file.Close(); err != nil {
+		return err
+	}
+	f, err := buildLogFile(e.filePath)
+	if err != nil {
+		return err
+	}
+	e.writer.w = f
+	e.writer.file = f
+	return nil
+}
+
+func buildErrorLogWriter(errorlogconfig *ErrorLogConfig) (io.Writer, *os.File, error) {
+	switch errorlogconfig.Output {
+	case "stderr", "":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	case "discard":
+		return io.Discard, nil, nil
+	case "file":
+		f, err := buildLogFile(errorlogconfig.FilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f, nil
+	default:
+		return nil, nil, fmt.Errorf("error log output is invalid value: %s", errorlogconfig.Output)
+	}
+}
+
+func buildErrorLogLevel(errorlogconfig *ErrorLogConfig) (slog.Level, error) {
+	if len(errorlogconfig.Level) == 0 {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(errorlogconfig.Level))); err != nil {
+		return 0, fmt.Errorf("error log level is invalid value: %s", errorlogconfig.Level)
+	}
+	return level, nil
+}
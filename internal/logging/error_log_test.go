@@ -0,0 +1,118 @@
+package logging_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/logging"
+)
+
+func TestErrorLogging(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "error.log")
+	errorlog, err := logging.NewErrorLogging(&logging.ErrorLogConfig{Output: "file", Level: "warn", FilePath: logfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorlog.Info("info message")
+	errorlog.Warn("warn message", "key", "value")
+	errorlog.StdLogger().Print("proxy error")
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(log), "info message") {
+		t.Errorf("expected info message isn't logged, but got: %s", log)
+	}
+
+	if !strings.Contains(string(log), `level=WARN msg="warn message" key=value`) {
+		t.Errorf("expected warn message is logged, but got: %s", log)
+	}
+
+	if !strings.Contains(string(log), `level=ERROR msg="proxy error"`) {
+		t.Errorf("expected std logger message is logged, but got: %s", log)
+	}
+}
+
+func TestErrorLogging_WithJSONFormat(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "error.log")
+	errorlog, err := logging.NewErrorLogging(&logging.ErrorLogConfig{Output: "file", Format: "json", FilePath: logfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorlog.Error("error message")
+	errorlog.Info("received SIGHUP")
+	errorlog.Debug("debug message")
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wont := range []string{`"level":"ERROR","msg":"error message"`, `"level":"INFO","msg":"received SIGHUP"`} {
+		if !strings.Contains(string(log), wont) {
+			t.Errorf("got: %s, wont: %s", log, wont)
+		}
+	}
+	if strings.Contains(string(log), "debug message") {
+		t.Errorf("expected debug message isn't logged by default, but got: %s", log)
+	}
+}
+
+func TestErrorLogging_InvalidLevel(t *testing.T) {
+	if _, err := logging.NewErrorLogging(&logging.ErrorLogConfig{Level: "verbose"}); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
+
+func TestErrorLogging_Reopen(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "error.log")
+	errorlog, err := logging.NewErrorLogging(&logging.ErrorLogConfig{Output: "file", FilePath: logfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorlog.Error("before reopen")
+
+	if err := os.Rename(logfile, path.Join(tempDir, "error_old.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := errorlog.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	errorlog.Error("after reopen")
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(log), "before reopen") || !strings.Contains(string(log), "after reopen") {
+		t.Errorf("unexpected log after reopen: %s", log)
+	}
+}
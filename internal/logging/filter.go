@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// SkipRule describes requests that aren't written to the access log. Every
+// condition that is set must match for the rule to apply.
+type SkipRule struct {
+	Paths      []string
+	Statuses   []string
+	UserAgents []string
+	Expr       string
+}
+
+type skipRule struct {
+	paths      []string
+	statuses   []statusRange
+	userAgents []string
+	expr       *template.Template
+}
+
+type statusRange struct {
+	from int
+	to   int
+}
+
+type logFilter struct {
+	rules      []skipRule
+	sampleRate float64
+}
+
+func buildLogFilter(logconfig *LogConfig) (*logFilter, error) {
+	sampleRate := 1.0
+	if logconfig.SampleRate != nil {
+		sampleRate = *logconfig.SampleRate
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("log sample rate is invalid value: %v", sampleRate)
+	}
+
+	filter := &logFilter{sampleRate: sampleRate}
+	for i, rule := range logconfig.Skip {
+		sr := skipRule{paths: rule.Paths, userAgents: rule.UserAgents}
+
+		for _, p := range rule.Paths {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("log skip path is invalid value: %s", p)
+			}
+		}
+
+		for _, s := range rule.Statuses {
+			r, err := parseStatusRange(s)
+			if err != nil {
+				return nil, err
+			}
+			if r.to >= 400 {
+				return nil, fmt.Errorf("log skip status is invalid value: %s; errors are always logged", s)
+			}
+			sr.statuses = append(sr.statuses, r)
+		}
+
+		if len(rule.Expr) != 0 {
+			t, err := template.New("logskip" + strconv.Itoa(i)).Parse(rule.Expr)
+			if err != nil {
+				return nil, err
+			}
+			sr.expr = t
+		}
+
+		filter.rules = append(filter.rules, sr)
+	}
+
+	return filter, nil
+}
+
+// skip reports whether the request shouldn't be logged. Errors (4xx and 5xx)
+// are always logged. Skip rules apply to other responses, and successful
+// responses are then sampled with the sample rate, so a rate of 0 drops all
+// of them.
+func (f *logFilter) skip(r *http.Request, lf LogFormat) bool {
+	if f == nil || lf.Status >= 400 {
+		return false
+	}
+
+	for _, rule := range f.rules {
+		if rule.match(r, lf) {
+			return true
+		}
+	}
+
+	if f.sampleRate < 1 && lf.Status >= 200 && lf.Status < 300 {
+		/* #nosec G404 */
+		return rand.Float64() >= f.sampleRate
+	}
+
+	return false
+}
+
+func (rule *skipRule) match(r *http.Request, lf LogFormat) bool {
+	if len(rule.paths) != 0 && !matchAny(rule.paths, func(p string) bool {
+		matched, _ := path.Match(p, r.URL.Path)
+		return matched
+	}) {
+		return false
+	}
+
+	if len(rule.statuses) != 0 && !matchAny(rule.statuses, func(s statusRange) bool {
+		return s.from <= lf.Status && lf.Status <= s.to
+	}) {
+		return false
+	}
+
+	if len(rule.userAgents) != 0 && !matchAny(rule.userAgents, func(ua string) bool {
+		return strings.Contains(lf.HttpUserAgent, ua)
+	}) {
+		return false
+	}
+
+	if rule.expr != nil {
+		wr := new(bytes.Buffer)
+		if err := rule.expr.Execute(wr, lf); err != nil {
+			return false
+		}
+		if b, err := strconv.ParseBool(strings.TrimSpace(wr.String())); err != nil || !b {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny[T any](values []T, match func(T) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusRange parses "404", "500-599" and "5xx".
+func parseStatusRange(s string) (statusRange, error) {
+	invalid := fmt.Errorf("log skip status is invalid value: %s", s)
+
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		n, err := strconv.Atoi(s[:1])
+		if err != nil {
+			return statusRange{}, invalid
+		}
+		return statusRange{from: n * 100, to: n*100 + 99}, nil
+	}
+
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+
+	f, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return statusRange{}, invalid
+	}
+	t, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || f > t {
+		return statusRange{}, invalid
+	}
+
+	return statusRange{from: f, to: t}, nil
+}
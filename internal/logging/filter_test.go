@@ -0,0 +1,111 @@
+package logging_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/logging"
+)
+
+func TestWriteHTTPLog_WithSkip(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "niwa.log")
+	skip := []logging.SkipRule{
+		{Paths: []string{"/health"}},
+		{Paths: []string{"/public/*.css"}, Statuses: []string{"2xx", "304"}},
+		{UserAgents: []string{"kube-probe/"}},
+		{Expr: `{{eq .RequestMethod "OPTIONS"}}`},
+	}
+	logger, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.RequestMethod}} {{.RequestURI}} {{.Status}}", Skip: skip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method    string
+		target    string
+		userAgent string
+		status    int
+	}{
+		{"GET", "/health", "", 200},
+		{"GET", "/health", "", 500},
+		{"GET", "/public/app.css", "", 304},
+		{"GET", "/public/app.css", "", 404},
+		{"GET", "/app", "kube-probe/1.27", 200},
+		{"OPTIONS", "/app", "", 204},
+		{"GET", "/app?q=1", "", 200},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		if err = logger.WriteHTTPLog(httptest.NewRecorder(), r, tt.status, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "GET /health 500\nGET /public/app.css 404\nGET /app?q=1 200\n"
+	if string(log) != wont {
+		t.Errorf("got: %s, wont: %s", log, wont)
+	}
+}
+
+func TestWriteHTTPLog_WithSampleRate(t *testing.T) {
+	zero := 0.0
+	tests := []struct {
+		sampleRate *float64
+		wont       string
+	}{
+		{nil, "200\n200\n502\n"},
+		{&zero, "502\n"},
+	}
+
+	for _, tt := range tests {
+		logfile := path.Join(t.TempDir(), "niwa.log")
+		logger, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.Status}}", SampleRate: tt.sampleRate})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusBadGateway} {
+			if err = logger.WriteHTTPLog(httptest.NewRecorder(), r, status, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		log, err := os.ReadFile(logfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(log) != tt.wont {
+			t.Errorf("got: %q, wont: %q", log, tt.wont)
+		}
+	}
+}
+
+func TestNew_WithInvalidSkip(t *testing.T) {
+	for _, status := range []string{"abc", "5xx", "300-404"} {
+		if _, err := logging.New(&logging.LogConfig{Skip: []logging.SkipRule{{Statuses: []string{status}}}}); err == nil {
+			t.Errorf("%s: expected error, but got nil", status)
+		}
+	}
+
+	invalid := 2.0
+	if _, err := logging.New(&logging.LogConfig{SampleRate: &invalid}); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
@@ -2,12 +2,14 @@ package logging
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -20,24 +22,74 @@ type Logging struct {
 	mu       sync.Mutex
 	file     *os.File
 	filePath string
+	remote   *remoteWriter
+	async    *asyncWriter
+	filter   *logFilter
 }
 
 type LogFormat struct {
 	RemoteAddr     string
 	TimeLocal      string
 	RequestMethod  string
+	RequestURI     string
 	ServerProtocol string
 	Status         int
 	BodyBytesSent  int
 	HttpReferer    string
 	HttpUserAgent  string
+	CacheStatus    string
+	RemoteUser     string
+	// Claims are the validated JWT claims, e.g. {{.Claims.sub}}.
+	Claims map[string]string
+	// ClientCertSubject and ClientCertSAN describe the verified TLS client
+	// certificate.
+	ClientCertSubject string
+	ClientCertSAN     string
+}
+
+type remoteUserContextKey struct{}
+
+type claimsContextKey struct{}
+
+type clientCertContextKey struct{}
+
+type clientCert struct {
+	subject string
+	san     string
+}
+
+// WithRemoteUser records the authenticated user for the access log.
+func WithRemoteUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), remoteUserContextKey{}, user))
+}
+
+// WithClientCert records the verified client certificate for the access log.
+func WithClientCert(r *http.Request, subject, san string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientCertContextKey{}, clientCert{subject: subject, san: san}))
+}
+
+// WithClaims records the validated JWT claims for the access log.
+func WithClaims(r *http.Request, claims map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims))
 }
 
 type LogConfig struct {
-	Output   string
-	Format   string
-	FilePath string
-	Escape   string
+	Output         string
+	Format         string
+	FilePath       string
+	Escape         string
+	SyslogAddress  string
+	SyslogFacility string
+	SyslogTag      string
+	Async          bool
+	BufferSize     int
+	FlushInterval  time.Duration
+	Overflow       string
+	ErrorLogging   *ErrorLogging
+	Skip           []SkipRule
+	// SampleRate is the fraction of 2xx responses to log. nil logs all of
+	// them and 0 logs none.
+	SampleRate *float64
 }
 
 type LogEscape int
@@ -48,7 +100,7 @@ func New(logconfig *LogConfig) (*Logging, error) {
 	var err error
 	logging := &Logging{filePath: logconfig.FilePath}
 
-	if logging.logger, logging.file, err = buildLogger(logconfig); err != nil {
+	if logging.logger, logging.file, logging.remote, err = buildLogger(logconfig); err != nil {
 		return nil, err
 	}
 
@@ -60,6 +112,19 @@ func New(logconfig *LogConfig) (*Logging, error) {
 		return nil, err
 	}
 
+	if logging.filter, err = buildLogFilter(logconfig); err != nil {
+		return nil, err
+	}
+
+	if logconfig.Async && logging.logger != nil {
+		onDrop := func(n uint64) {
+			logconfig.ErrorLogging.Warn("access log lines dropped", "count", n)
+		}
+		if logging.async, err = newAsyncWriter(logconfig, logging.writeLines, onDrop); err != nil {
+			return nil, err
+		}
+	}
+
 	return logging, nil
 }
 
@@ -82,19 +147,56 @@ func (l *Logging) Write(lf LogFormat) error {
 		msg = string(b)
 	}
 
+	if l.async != nil {
+		l.async.Write(msg)
+		return nil
+	}
+
 	l.mu.Lock()
 	l.logger.Println(msg)
 	l.mu.Unlock()
 	return nil
 }
 
+func (l *Logging) writeLines(msgs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, msg := range msgs {
+		l.logger.Println(msg)
+	}
+}
+
+// Dropped returns the number of lines dropped because the async buffer was full.
+func (l *Logging) Dropped() uint64 {
+	if l == nil || l.async == nil {
+		return 0
+	}
+	return l.async.Dropped()
+}
+
 func (l *Logging) WriteHTTPLog(w http.ResponseWriter, r *http.Request, status int, contentLength int) error {
+	if l == nil || l.logger == nil {
+		return nil
+	}
+
 	t := time.Now()
-	lf := LogFormat{RemoteAddr: r.RemoteAddr, TimeLocal: t.Format("02/Jan/2006:15:04:05 -0700"), RequestMethod: r.Method, ServerProtocol: r.Proto, Status: status, BodyBytesSent: contentLength, HttpReferer: r.Referer(), HttpUserAgent: r.UserAgent()}
+	lf := LogFormat{RemoteAddr: r.RemoteAddr, TimeLocal: t.Format("02/Jan/2006:15:04:05 -0700"), RequestMethod: r.Method, RequestURI: r.RequestURI, ServerProtocol: r.Proto, Status: status, BodyBytesSent: contentLength, HttpReferer: r.Referer(), HttpUserAgent: r.UserAgent(), CacheStatus: w.Header().Get("X-Cache-Status")}
+	lf.RemoteUser, _ = r.Context().Value(remoteUserContextKey{}).(string)
+	lf.Claims, _ = r.Context().Value(claimsContextKey{}).(map[string]string)
+	if cert, ok := r.Context().Value(clientCertContextKey{}).(clientCert); ok {
+		lf.ClientCertSubject, lf.ClientCertSAN = cert.subject, cert.san
+	}
+	if l.filter.skip(r, lf) {
+		return nil
+	}
 	return l.Write(lf)
 }
 
 func (l *Logging) Reopen() error {
+	if l.async != nil {
+		l.async.Flush()
+	}
 	if l.file == nil {
 		return nil
 	}
@@ -116,24 +218,55 @@ func (l *Logging) Reopen() error {
 	return nil
 }
 
-func buildLogger(logconfig *LogConfig) (*log.Logger, *os.File, error) {
-	switch logconfig.Output {
-	case "stdout":
-		return log.New(os.Stdout, "", 0), nil, nil
-	case "":
-		return log.New(os.Stdout, "", 0), nil, nil
-	case "stderr":
-		return log.New(os.Stderr, "", 0), nil, nil
-	case "discard":
-		return nil, nil, nil
-	case "file":
+func (l *Logging) Close() error {
+	if l == nil {
+		return nil
+	}
+	if l.async != nil {
+		l.async.Close()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.remote != nil {
+		return l.remote.Close()
+	}
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+func buildLogger(logconfig *LogConfig) (*log.Logger, *os.File, *remoteWriter, error) {
+	switch {
+	case logconfig.Output == "stdout":
+		return log.New(os.Stdout, "", 0), nil, nil, nil
+	case logconfig.Output == "":
+		return log.New(os.Stdout, "", 0), nil, nil, nil
+	case logconfig.Output == "stderr":
+		return log.New(os.Stderr, "", 0), nil, nil, nil
+	case logconfig.Output == "discard":
+		return nil, nil, nil, nil
+	case logconfig.Output == "file":
 		f, err := buildLogFile(logconfig.FilePath)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
+		}
+		return log.New(f, "", 0), f, nil, nil
+	case logconfig.Output == "syslog":
+		w, err := buildSyslogWriter(logconfig)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return log.New(w, "", 0), nil, w, nil
+	case strings.HasPrefix(logconfig.Output, "tcp://"), strings.HasPrefix(logconfig.Output, "udp://"):
+		w, err := buildNetworkWriter(logconfig.Output)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		return log.New(f, "", 0), f, nil
+		return log.New(w, "", 0), nil, w, nil
 	default:
-		return nil, nil, fmt.Errorf("log format is invalid value: %s", logconfig.Output)
+		return nil, nil, nil, fmt.Errorf("log format is invalid value: %s", logconfig.Output)
 	}
 }
 
@@ -143,7 +276,8 @@ func buildLogFormatTemplate(logconfig *LogConfig) (*template.Template, error) {
 		format = defaultLogFormat
 	}
 
-	return template.New("logformat").Parse(format)
+	// Claims missing from the token are written as empty strings.
+	return template.New("logformat").Option("missingkey=zero").Parse(format)
 }
 
 func buildLogEscape(logconfig *LogConfig) (string, error) {
@@ -1,9 +1,14 @@
 package logging_test
 
 import (
+	"io"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/y-yagi/niwa/internal/logging"
 )
@@ -158,3 +163,138 @@ func TestReopen(t *testing.T) {
 		t.Errorf("got: %s, wont: %s", log, wont)
 	}
 }
+
+func TestWrite_WithAsync(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "niwa.log")
+	logger, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.Status}}", Async: true, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []int{200, 404} {
+		if err = logger.Write(logging.LogFormat{Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Rename(logfile, path.Join(tempDir, "niwa_old.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen flushes the queued lines to the old file before switching.
+	if err := logger.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(path.Join(tempDir, "niwa_old.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "200\n404\n"
+	if string(log) != wont {
+		t.Errorf("got: %s, wont: %s", log, wont)
+	}
+
+	if err = logger.Write(logging.LogFormat{Status: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err = os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont = "500\n"
+	if string(log) != wont {
+		t.Errorf("got: %s, wont: %s", log, wont)
+	}
+}
+
+func TestWrite_WithAsyncDropOverflow(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Nobody reads the FIFO until the end, so the background writer stalls
+	// once the pipe buffer is full and the queue overflows.
+	fifo := path.Join(tempDir, "niwa.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	format := strings.Repeat("x", 128*1024)
+	logger, err := logging.New(&logging.LogConfig{Output: "file", FilePath: fifo, Format: format, Async: true, BufferSize: 1, Overflow: "drop", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = logger.Write(logging.LogFormat{Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if logger.Dropped() == 0 {
+		t.Errorf("expected some lines were dropped, but nothing was dropped")
+	}
+
+	r, err := os.Open(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	if err := logger.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_WithInvalidOverflow(t *testing.T) {
+	if _, err := logging.New(&logging.LogConfig{Async: true, Overflow: "ignore"}); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
+
+func TestWriteHTTPLog_WithClaims(t *testing.T) {
+	logfile := path.Join(t.TempDir(), "niwa.log")
+	logger, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.RemoteUser}} {{.Claims.sub}} {{.Claims.scope}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = logging.WithRemoteUser(r, "alice")
+	r = logging.WithClaims(r, map[string]string{"sub": "alice", "scope": "read"})
+	if err = logger.WriteHTTPLog(httptest.NewRecorder(), r, 200, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = logger.WriteHTTPLog(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), 200, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "alice alice read\n  \n"
+	if string(log) != wont {
+		t.Errorf("got: %q, wont: %q", log, wont)
+	}
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Loggings writes every access log entry to each of its Logging.
+type Loggings []*Logging
+
+func (ls Loggings) Write(lf LogFormat) error {
+	var errs []error
+	for _, l := range ls {
+		errs = append(errs, l.Write(lf))
+	}
+	return errors.Join(errs...)
+}
+
+func (ls Loggings) WriteHTTPLog(w http.ResponseWriter, r *http.Request, status int, contentLength int) error {
+	var errs []error
+	for _, l := range ls {
+		errs = append(errs, l.WriteHTTPLog(w, r, status, contentLength))
+	}
+	return errors.Join(errs...)
+}
+
+func (ls Loggings) Reopen() error {
+	var errs []error
+	for _, l := range ls {
+		errs = append(errs, l.Reopen())
+	}
+	return errors.Join(errs...)
+}
+
+func (ls Loggings) Close() error {
+	var errs []error
+	for _, l := range ls {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,287 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	remoteWriterBufferSize   = 1024
+	remoteWriterDialTimeout  = 5 * time.Second
+	remoteWriterWriteTimeout = 5 * time.Second
+	remoteWriterMinBackoff   = 100 * time.Millisecond
+	remoteWriterMaxBackoff   = 30 * time.Second
+	remoteWriterCloseTimeout = 5 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// remoteWriter sends each written line to a remote collector from a background
+// goroutine. Writes never block: lines are queued and dropped when the queue is
+// full, and the connection is re-established with backoff when it breaks.
+type remoteWriter struct {
+	network string
+	address string
+	frame   func([]byte) []byte
+	queue   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	conn    net.Conn
+	broken  chan struct{}
+	backoff time.Duration
+	dropped atomic.Uint64
+}
+
+func newRemoteWriter(network, address string, frame func([]byte) []byte) *remoteWriter {
+	w := &remoteWriter{
+		network: network,
+		address: address,
+		frame:   frame,
+		queue:   make(chan []byte, remoteWriterBufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		backoff: remoteWriterMinBackoff,
+	}
+	go w.run()
+	return w
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	select {
+	case <-w.done:
+		w.dropped.Add(1)
+		return len(p), nil
+	default:
+	}
+
+	select {
+	case w.queue <- b:
+	default:
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Close sends queued lines and closes the connection. Lines that can't be sent
+// before the close timeout are dropped.
+func (w *remoteWriter) Close() error {
+	w.once.Do(func() { close(w.done) })
+
+	select {
+	case <-w.stopped:
+		return nil
+	case <-time.After(remoteWriterCloseTimeout):
+		return fmt.Errorf("remote log %s://%s close timed out", w.network, w.address)
+	}
+}
+
+func (w *remoteWriter) run() {
+	defer close(w.stopped)
+
+	for {
+		select {
+		case b := <-w.queue:
+			w.send(b)
+		case <-w.done:
+			for {
+				select {
+				case b := <-w.queue:
+					w.send(b)
+				default:
+					if w.conn != nil {
+						_ = w.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *remoteWriter) send(b []byte) {
+	msg := w.frame(b)
+
+	for {
+		if w.conn != nil {
+			select {
+			case <-w.broken:
+				_ = w.conn.Close()
+				w.conn = nil
+			default:
+			}
+		}
+
+		if w.conn == nil {
+			conn, err := net.DialTimeout(w.network, w.address, remoteWriterDialTimeout)
+			if err != nil {
+				if !w.wait() {
+					w.dropped.Add(1)
+					return
+				}
+				continue
+			}
+			w.conn = conn
+			w.broken = watchConn(conn)
+		}
+
+		_ = w.conn.SetWriteDeadline(time.Now().Add(remoteWriterWriteTimeout))
+		if _, err := w.conn.Write(msg); err != nil {
+			_ = w.conn.Close()
+			w.conn = nil
+			if !w.wait() {
+				w.dropped.Add(1)
+				return
+			}
+			continue
+		}
+
+		w.backoff = remoteWriterMinBackoff
+		return
+	}
+}
+
+// watchConn returns a channel that is closed once the peer closes conn.
+// Collectors never send anything back, so any read result means the
+// connection is gone and writes to it would be silently lost.
+func watchConn(conn net.Conn) chan struct{} {
+	broken := make(chan struct{})
+	go func() {
+		defer close(broken)
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return broken
+}
+
+// wait sleeps for the current backoff and reports false if the writer was
+// closed meanwhile.
+func (w *remoteWriter) wait() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+
+	t := time.NewTimer(w.backoff)
+	defer t.Stop()
+
+	w.backoff *= 2
+	if w.backoff > remoteWriterMaxBackoff {
+		w.backoff = remoteWriterMaxBackoff
+	}
+
+	select {
+	case <-w.done:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func buildNetworkWriter(output string) (*remoteWriter, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("log output address is missing: %s", output)
+	}
+
+	return newRemoteWriter(u.Scheme, u.Host, func(b []byte) []byte {
+		return b
+	}), nil
+}
+
+func buildSyslogWriter(logconfig *LogConfig) (*remoteWriter, error) {
+	facility := syslogFacilities["local0"]
+	if logconfig.SyslogFacility != "" {
+		f, found := syslogFacilities[logconfig.SyslogFacility]
+		if !found {
+			return nil, fmt.Errorf("syslog facility is invalid value: %s", logconfig.SyslogFacility)
+		}
+		facility = f
+	}
+
+	tag := logconfig.SyslogTag
+	if tag == "" {
+		tag = "niwa"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	network, address, err := parseSyslogAddress(logconfig.SyslogAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 5424 with severity "informational". Stream transports use octet
+	// counting (RFC 6587) so messages can't run into each other.
+	pri := facility*8 + 6
+	pid := os.Getpid()
+	return newRemoteWriter(network, address, func(b []byte) []byte {
+		if n := len(b); n > 0 && b[n-1] == '\n' {
+			b = b[:n-1]
+		}
+		timestamp := time.Now().Format("2006-01-02T15:04:05.000000Z07:00")
+		msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, timestamp, hostname, tag, pid, b)
+		if network == "tcp" || network == "unix" {
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		return []byte(msg)
+	}), nil
+}
+
+func parseSyslogAddress(address string) (string, string, error) {
+	if address == "" {
+		for _, path := range syslogLocalPaths {
+			if _, err := os.Stat(path); err == nil {
+				return "unixgram", path, nil
+			}
+		}
+		return "", "", errors.New("local syslog socket is not found")
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("syslog address is invalid value: %s", address)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("syslog address is invalid value: %s", address)
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("syslog address is invalid value: %s", address)
+	}
+}
@@ -0,0 +1,128 @@
+package logging_test
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/logging"
+)
+
+func TestWrite_WithUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	logger, err := logging.New(&logging.LogConfig{Output: "udp://" + conn.LocalAddr().String(), Format: "RemoteAddr: {{.RemoteAddr}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	lf := logging.LogFormat{RemoteAddr: "192.168.1.1"}
+	if err = logger.Write(lf); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "RemoteAddr: 192.168.1.1\n"
+	if string(buf[:n]) != wont {
+		t.Errorf("got: %s, wont: %s", buf[:n], wont)
+	}
+}
+
+func TestWrite_WithTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			// Drop the connection after every line so the writer has to reconnect.
+			conn.Close()
+			if err == nil {
+				lines <- line
+			}
+		}
+	}()
+
+	logger, err := logging.New(&logging.LogConfig{Output: "tcp://" + ln.Addr().String(), Format: "{{.Status}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	for _, status := range []int{200, 404} {
+		if err = logger.Write(logging.LogFormat{Status: status}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case line := <-lines:
+			if strings.TrimSpace(line) != strconv.Itoa(status) {
+				t.Errorf("got: %s, wont: %d", line, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("log line for %d wasn't received", status)
+		}
+
+		// Give the writer a moment to notice the closed connection.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWrite_WithSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	logger, err := logging.New(&logging.LogConfig{Output: "syslog", SyslogAddress: "udp://" + conn.LocalAddr().String(), SyslogFacility: "local7", SyslogTag: "niwatest", Format: "{{.RequestMethod}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	if err = logger.Write(logging.LogFormat{RequestMethod: "GET"}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re := regexp.MustCompile(`^<190>1 \S+ \S+ niwatest \d+ - - GET$`)
+	if !re.Match(buf[:n]) {
+		t.Errorf("unexpected syslog message: %q", buf[:n])
+	}
+}
+
+func TestNew_WithInvalidSyslogFacility(t *testing.T) {
+	if _, err := logging.New(&logging.LogConfig{Output: "syslog", SyslogAddress: "udp://127.0.0.1:514", SyslogFacility: "unknown"}); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
@@ -0,0 +1,175 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Headers set on requests to upstreams from the verified client certificate.
+// Values sent by clients are always dropped.
+const (
+	SubjectHeader = "X-Client-Cert-Subject"
+	SANHeader     = "X-Client-Cert-San"
+)
+
+// ParseClientAuth maps the client_auth setting to the tls package's type.
+// The default is "require".
+func ParseClientAuth(v string) (tls.ClientAuthType, error) {
+	switch v {
+	case "", "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify_if_given":
+		return tls.VerifyClientCertIfGiven, nil
+	}
+	return tls.NoClientCert, errors.New("client auth is invalid value: " + v)
+}
+
+// LoadCertPool reads the PEM certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
+
+type clientCertContextKey struct{}
+
+// Verifier finds the verified client certificate of a request. Certificates
+// the TLS handshake requested but did not verify ("request") are verified
+// against the roots here.
+type Verifier struct {
+	roots *x509.CertPool
+}
+
+func NewVerifier(roots *x509.CertPool) *Verifier {
+	return &Verifier{roots: roots}
+}
+
+// Forward removes the client certificate headers sent by the client and sets
+// them from the verified certificate, which is also stored for FromRequest.
+// A nil Verifier only removes the headers.
+func (v *Verifier) Forward(r *http.Request) *http.Request {
+	r.Header.Del(SubjectHeader)
+	r.Header.Del(SANHeader)
+
+	cert := v.verify(r)
+	if cert == nil {
+		return r
+	}
+
+	r.Header.Set(SubjectHeader, Subject(cert))
+	if sans := SANs(cert); len(sans) != 0 {
+		r.Header.Set(SANHeader, strings.Join(sans, ","))
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientCertContextKey{}, cert))
+}
+
+func (v *Verifier) verify(r *http.Request) *x509.Certificate {
+	if v == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	if len(r.TLS.VerifiedChains) != 0 {
+		return r.TLS.VerifiedChains[0][0]
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := r.TLS.PeerCertificates[0].Verify(opts); err != nil {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// FromRequest returns the certificate verified by Forward, or nil.
+func FromRequest(r *http.Request) *x509.Certificate {
+	cert, _ := r.Context().Value(clientCertContextKey{}).(*x509.Certificate)
+	return cert
+}
+
+// Subject is the RFC 2253 form of the certificate subject, e.g.
+// "CN=client,O=Example".
+func Subject(cert *x509.Certificate) string {
+	return cert.Subject.String()
+}
+
+// SANs are the subject alternative names in OpenSSL's typed form, e.g.
+// "DNS:client.example.com" or "URI:spiffe://example.com/client".
+func SANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, v := range cert.DNSNames {
+		sans = append(sans, "DNS:"+v)
+	}
+	for _, v := range cert.EmailAddresses {
+		sans = append(sans, "email:"+v)
+	}
+	for _, v := range cert.IPAddresses {
+		sans = append(sans, "IP:"+v.String())
+	}
+	for _, v := range cert.URIs {
+		sans = append(sans, "URI:"+v.String())
+	}
+	return sans
+}
+
+type RequirementConfig struct {
+	// CommonNames and SANs, when set, limit the accepted certificates. A
+	// certificate matching either list is accepted.
+	CommonNames []string
+	SANs        []string
+}
+
+// Requirement requires a verified client certificate for a routing.
+type Requirement struct {
+	commonNames []string
+	sans        []string
+}
+
+func NewRequirement(rconfig *RequirementConfig) *Requirement {
+	return &Requirement{commonNames: rconfig.CommonNames, sans: rconfig.SANs}
+}
+
+// Allow reports whether the request has an acceptable certificate.
+// Otherwise it responds with 403 and returns false. A nil Requirement allows
+// everything.
+func (req *Requirement) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if req == nil {
+		return true
+	}
+
+	if cert := FromRequest(r); cert != nil && req.accepts(cert) {
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+func (req *Requirement) accepts(cert *x509.Certificate) bool {
+	if len(req.commonNames) == 0 && len(req.sans) == 0 {
+		return true
+	}
+	if slices.Contains(req.commonNames, cert.Subject.CommonName) {
+		return true
+	}
+	return slices.ContainsFunc(SANs(cert), func(san string) bool { return slices.Contains(req.sans, san) })
+}
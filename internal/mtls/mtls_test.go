@@ -0,0 +1,175 @@
+package mtls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/mtls"
+)
+
+func newCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+}
+
+func newClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, cn string) *x509.Certificate {
+	spiffe, _ := url.Parse("spiffe://example.com/" + cn)
+	cert, _ := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		DNSNames:    []string{cn + ".example.com"},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	return cert
+}
+
+func TestVerifier_Forward(t *testing.T) {
+	ca, caKey := newCA(t)
+	other, otherKey := newCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	v := mtls.NewVerifier(roots)
+
+	client := newClientCert(t, ca, caKey, "client")
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		wont  string
+	}{
+		{"verified by handshake", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}, VerifiedChains: [][]*x509.Certificate{{client, ca}}}, "CN=client,O=Example"},
+		{"verified here", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}, "CN=client,O=Example"},
+		{"unknown CA", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newClientCert(t, other, otherKey, "client")}}, ""},
+		{"no certificate", &tls.ConnectionState{}, ""},
+		{"plain HTTP", nil, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = tt.state
+		r.Header.Set(mtls.SubjectHeader, "CN=spoofed")
+		r.Header.Set(mtls.SANHeader, "DNS:spoofed")
+
+		r = v.Forward(r)
+		if got := r.Header.Get(mtls.SubjectHeader); got != tt.wont {
+			t.Errorf("%s: got: %q, wont: %q", tt.name, got, tt.wont)
+		}
+		if (mtls.FromRequest(r) != nil) != (tt.wont != "") {
+			t.Errorf("%s: got certificate: %v", tt.name, mtls.FromRequest(r))
+		}
+		if tt.wont == "" && r.Header.Get(mtls.SANHeader) != "" {
+			t.Errorf("%s: client SAN header was kept", tt.name)
+		}
+		if tt.wont != "" && r.Header.Get(mtls.SANHeader) != "DNS:client.example.com,URI:spiffe://example.com/client" {
+			t.Errorf("%s: got SAN: %s", tt.name, r.Header.Get(mtls.SANHeader))
+		}
+	}
+
+	var nilVerifier *mtls.Verifier
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(mtls.SubjectHeader, "CN=spoofed")
+	if r = nilVerifier.Forward(r); r.Header.Get(mtls.SubjectHeader) != "" {
+		t.Error("nil verifier kept the client header")
+	}
+}
+
+func TestRequirement(t *testing.T) {
+	ca, caKey := newCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	v := mtls.NewVerifier(roots)
+
+	tests := []struct {
+		name   string
+		config mtls.RequirementConfig
+		cn     string
+		ok     bool
+	}{
+		{"any certificate", mtls.RequirementConfig{}, "client", true},
+		{"no certificate", mtls.RequirementConfig{}, "", false},
+		{"common name", mtls.RequirementConfig{CommonNames: []string{"client"}}, "client", true},
+		{"other common name", mtls.RequirementConfig{CommonNames: []string{"admin"}}, "client", false},
+		{"SAN", mtls.RequirementConfig{SANs: []string{"URI:spiffe://example.com/client"}}, "client", true},
+		{"other SAN", mtls.RequirementConfig{SANs: []string{"DNS:admin.example.com"}}, "client", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.cn != "" {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newClientCert(t, ca, caKey, tt.cn)}}
+		}
+		w := httptest.NewRecorder()
+
+		if got := mtls.NewRequirement(&tt.config).Allow(w, v.Forward(r)); got != tt.ok {
+			t.Errorf("%s: got: %v, wont: %v", tt.name, got, tt.ok)
+		}
+		if !tt.ok && w.Code != http.StatusForbidden {
+			t.Errorf("%s: got: %d, wont: 403", tt.name, w.Code)
+		}
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := map[string]tls.ClientAuthType{
+		"":                tls.RequireAndVerifyClientCert,
+		"require":         tls.RequireAndVerifyClientCert,
+		"request":         tls.RequestClientCert,
+		"verify_if_given": tls.VerifyClientCertIfGiven,
+	}
+	for v, wont := range tests {
+		if got, err := mtls.ParseClientAuth(v); err != nil || got != wont {
+			t.Errorf("%q: got: %v %v, wont: %v", v, got, err, wont)
+		}
+	}
+	if _, err := mtls.ParseClientAuth("optional"); err == nil {
+		t.Error("expected an error for an invalid value")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	ca, _ := newCA(t)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mtls.LoadCertPool(file); err != nil {
+		t.Error(err)
+	}
+	if _, err := mtls.LoadCertPool("../../testdata/user.json"); err == nil {
+		t.Error("expected an error for a file without certificates")
+	}
+}
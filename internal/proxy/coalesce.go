@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type CoalesceConfig struct {
+	Enabled bool
+	// Headers are added to the key, so requests that differ in them are
+	// never shared.
+	Headers []string
+	// MaxBuffer is how far, in bytes, a client may fall behind the fastest
+	// client of a shared response before it is cut off.
+	MaxBuffer int64
+}
+
+const defaultCoalesceMaxBuffer = 1 << 20
+
+type coalesceKeyContextKey struct{}
+
+// coalesceTransport collapses identical requests that are in flight at the
+// same time into one upstream request, whose response is then streamed to
+// every waiting client.
+type coalesceTransport struct {
+	base      http.RoundTripper
+	headers   []string
+	maxBuffer int
+
+	mu    sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+// coalesceCall is one upstream request shared by refs clients. It is removed
+// from the map once the response headers arrive, so only requests sent while
+// the upstream is still thinking join it.
+type coalesceCall struct {
+	t      *coalesceTransport
+	key    string
+	ready  chan struct{}
+	res    *http.Response
+	err    error
+	body   *sharedBody
+	cancel context.CancelFunc
+	// private is set when the response must only go to the client that sent
+	// the request.
+	private bool
+
+	mu   sync.Mutex
+	refs int
+}
+
+// buildCoalesceTransport returns nil unless coalescing is enabled.
+func buildCoalesceTransport(base http.RoundTripper, cc CoalesceConfig) *coalesceTransport {
+	if !cc.Enabled {
+		return nil
+	}
+
+	t := &coalesceTransport{base: base, maxBuffer: int(cc.MaxBuffer), calls: map[string]*coalesceCall{}}
+	if t.maxBuffer <= 0 {
+		t.maxBuffer = defaultCoalesceMaxBuffer
+	}
+	for _, h := range cc.Headers {
+		t.headers = append(t.headers, http.CanonicalHeaderKey(h))
+	}
+	return t
+}
+
+// key returns the coalescing key of a downstream request, or "" when it must
+// not be shared: requests with a body, upgrades, event streams and requests
+// carrying credentials that aren't part of the key.
+func (t *coalesceTransport) key(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return ""
+	}
+	for _, credential := range []string{"Authorization", "Cookie"} {
+		if r.Header.Get(credential) != "" && !t.keyed(credential) {
+			return ""
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.Host + r.URL.RequestURI())
+	for _, h := range t.headers {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ", "))
+	}
+	return b.String()
+}
+
+func (t *coalesceTransport) withKey(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, coalesceKeyContextKey{}, t.key(r))
+}
+
+func (t *coalesceTransport) keyed(header string) bool {
+	for _, h := range t.headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *coalesceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := req.Context().Value(coalesceKeyContextKey{}).(string)
+	if !ok || key == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	c, found := t.calls[key]
+	if !found {
+		// The upstream request outlives any single client; it is canceled
+		// once every client has gone.
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		c = &coalesceCall{t: t, key: key, ready: make(chan struct{}), cancel: cancel}
+		t.calls[key] = c
+		go c.do(req.WithContext(ctx))
+	}
+	c.mu.Lock()
+	c.refs++
+	c.mu.Unlock()
+	t.mu.Unlock()
+
+	select {
+	case <-c.ready:
+	case <-req.Context().Done():
+		c.abandon()
+		return nil, req.Context().Err()
+	}
+
+	if c.err != nil {
+		c.abandon()
+		return nil, c.err
+	}
+	if c.private && found {
+		// The response belongs to the client that sent the request, so this
+		// one goes upstream on its own.
+		c.abandon()
+		return t.base.RoundTrip(req)
+	}
+
+	res := *c.res
+	res.Header = c.res.Header.Clone()
+	res.Trailer = c.res.Trailer.Clone()
+	res.Request = req
+	res.Body = c.bodyFor(req.Context())
+	return &res, nil
+}
+
+func (c *coalesceCall) do(req *http.Request) {
+	res, err := c.t.base.RoundTrip(req)
+
+	c.t.mu.Lock()
+	c.t.forget(c)
+	c.t.mu.Unlock()
+
+	c.mu.Lock()
+	c.res, c.err = res, err
+	c.private = res != nil && !c.t.shareable(res)
+	// Every client may have gone while waiting.
+	if c.refs == 0 && res != nil {
+		_ = res.Body.Close()
+	}
+	c.mu.Unlock()
+	close(c.ready)
+}
+
+// shareable reports whether a response may be sent to clients other than the
+// one whose request produced it: it must not set cookies, must not be marked
+// private or no-store, and must only vary on headers that are in the key.
+func (t *coalesceTransport) shareable(res *http.Response) bool {
+	if len(res.Header.Values("Set-Cookie")) != 0 {
+		return false
+	}
+	for _, v := range res.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") {
+				return false
+			}
+		}
+	}
+	for _, v := range res.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !t.keyed(http.CanonicalHeaderKey(h)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *coalesceTransport) forget(c *coalesceCall) {
+	if t.calls[c.key] == c {
+		delete(t.calls, c.key)
+	}
+}
+
+// bodyFor returns the body for one client. A client that turns out to be
+// alone, or the only one a private response goes to, reads the upstream body
+// directly, without buffering it.
+func (c *coalesceCall) bodyFor(ctx context.Context) io.ReadCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.body == nil {
+		if c.refs == 1 || c.private {
+			return &releaseBody{ReadCloser: c.res.Body, release: c.release}
+		}
+		c.body = newSharedBody(c.res.Body, c.refs, c.t.maxBuffer)
+	}
+	return c.body.reader(ctx, c.release)
+}
+
+// release drops one client; the last one stops the upstream request.
+func (c *coalesceCall) release() {
+	c.drop(false)
+}
+
+// abandon drops a client that gives up without asking for the body.
+func (c *coalesceCall) abandon() {
+	c.drop(true)
+}
+
+func (c *coalesceCall) drop(abandoned bool) {
+	c.t.mu.Lock()
+	c.mu.Lock()
+	c.refs--
+	// The shared body counted this client when it was created.
+	if abandoned && c.body != nil {
+		c.body.abandon()
+	}
+	last := c.refs == 0
+	res := c.res
+	if last {
+		// Nobody may join a request that is about to be canceled.
+		c.t.forget(c)
+	}
+	c.mu.Unlock()
+	c.t.mu.Unlock()
+
+	if last {
+		if res != nil {
+			_ = res.Body.Close()
+		}
+		c.cancel()
+	}
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// sharedBody reads the upstream body once and lets every client read it from
+// the start at its own pace. Only the part some client hasn't read yet is
+// kept, and a client that falls more than max bytes behind the fastest one is
+// cut off, so a stalled client can't make the buffer grow without bound.
+type sharedBody struct {
+	src io.ReadCloser
+	max int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// buf holds the body from offset base on.
+	buf  []byte
+	base int
+	// pending counts the clients that haven't asked for their reader yet.
+	// They start at offset 0, so nothing is dropped from buf until they have.
+	pending int
+	readers map[*sharedBodyReader]struct{}
+	err     error
+	reading bool
+}
+
+var errCoalesceLagged = errors.New("coalesce: client fell too far behind the shared response")
+
+func newSharedBody(src io.ReadCloser, clients int, max int) *sharedBody {
+	b := &sharedBody{src: src, max: max, pending: clients, readers: map[*sharedBodyReader]struct{}{}}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *sharedBody) reader(ctx context.Context, release func()) io.ReadCloser {
+	r := &sharedBodyReader{body: b, ctx: ctx, release: release}
+	r.stop = context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+
+	b.mu.Lock()
+	b.pending--
+	b.readers[r] = struct{}{}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return r
+}
+
+func (b *sharedBody) abandon() {
+	b.mu.Lock()
+	b.pending--
+	b.trim()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// fill reads the next chunk from the upstream. Only one client reads from it
+// at a time; the others wait for the chunk to be appended.
+func (b *sharedBody) fill() {
+	b.reading = true
+	b.makeRoom()
+	b.mu.Unlock()
+
+	p := make([]byte, 32*1024)
+	n, err := b.src.Read(p)
+
+	b.mu.Lock()
+	b.buf = append(b.buf, p[:n]...)
+	if err != nil {
+		b.err = err
+	}
+	b.reading = false
+	b.cond.Broadcast()
+}
+
+// makeRoom cuts off the slowest clients until the buffer is below max. The
+// client about to fill is at the end of the buffer, so it is never cut.
+// Clients that haven't asked for their reader yet are about to, so they are
+// waited for rather than cut.
+func (b *sharedBody) makeRoom() {
+	for len(b.buf) >= b.max {
+		if b.pending > 0 {
+			b.cond.Wait()
+			continue
+		}
+		for r := range b.readers {
+			if r.off == b.base {
+				r.err = errCoalesceLagged
+				delete(b.readers, r)
+			}
+		}
+		b.trim()
+	}
+}
+
+// trim drops the part of the buffer every client has read.
+func (b *sharedBody) trim() {
+	if b.pending > 0 {
+		return
+	}
+	end := b.base + len(b.buf)
+	for r := range b.readers {
+		end = min(end, r.off)
+	}
+	b.buf = b.buf[end-b.base:]
+	b.base = end
+}
+
+type sharedBodyReader struct {
+	body    *sharedBody
+	ctx     context.Context
+	off     int
+	err     error
+	release func()
+	stop    func() bool
+	once    sync.Once
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for r.err == nil && r.off == b.base+len(b.buf) && b.err == nil {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		if b.reading {
+			b.cond.Wait()
+			continue
+		}
+		b.fill()
+	}
+
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.off == b.base+len(b.buf) {
+		return 0, b.err
+	}
+	n := copy(p, b.buf[r.off-b.base:])
+	r.off += n
+	b.trim()
+	return n, nil
+}
+
+func (r *sharedBodyReader) Close() error {
+	r.once.Do(func() {
+		r.stop()
+		b := r.body
+		b.mu.Lock()
+		delete(b.readers, r)
+		b.trim()
+		b.mu.Unlock()
+		r.release()
+	})
+	return nil
+}
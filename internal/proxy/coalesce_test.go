@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type blockingTransport struct {
+	release chan struct{}
+	header  http.Header
+	body    []byte
+	calls   atomic.Int32
+}
+
+func (bt *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bt.calls.Add(1)
+	<-bt.release
+	return &http.Response{StatusCode: http.StatusOK, Header: bt.header.Clone(), Body: io.NopCloser(bytes.NewReader(bt.body)), Request: req}, nil
+}
+
+// waitForRefs waits until n requests have joined a call.
+func waitForRefs(ct *coalesceTransport, n int) {
+	for {
+		ct.mu.Lock()
+		var refs int
+		for _, c := range ct.calls {
+			c.mu.Lock()
+			refs = c.refs
+			c.mu.Unlock()
+		}
+		ct.mu.Unlock()
+		if refs == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesce_MaxBuffer(t *testing.T) {
+	const size = 4 << 20
+	bt := &blockingTransport{release: make(chan struct{}), body: bytes.Repeat([]byte("x"), size)}
+	ct := buildCoalesceTransport(bt, CoalesceConfig{Enabled: true, MaxBuffer: 64 << 10})
+
+	responses := make(chan *http.Response, 2)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "http://niwa.test/large", nil)
+		req := r.WithContext(ct.withKey(r.Context(), r))
+		go func() {
+			res, err := ct.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+			}
+			responses <- res
+		}()
+	}
+
+	// Wait for both requests to join the call before the upstream answers.
+	waitForRefs(ct, 2)
+	close(bt.release)
+
+	fast, slow := <-responses, <-responses
+	if fast == nil || slow == nil {
+		t.FailNow()
+	}
+
+	// The fast client isn't held back by the one that doesn't read.
+	if n, err := io.Copy(io.Discard, fast.Body); err != nil || n != size {
+		t.Fatalf("got: %d %v, wont: %d bytes", n, err, size)
+	}
+	if n, err := io.Copy(io.Discard, slow.Body); !errors.Is(err, errCoalesceLagged) || n != 0 {
+		t.Errorf("got: %d %v, wont: %v", n, err, errCoalesceLagged)
+	}
+
+	body := fast.Body.(*sharedBodyReader).body
+	body.mu.Lock()
+	if len(body.buf) > 64<<10 {
+		t.Errorf("got: %d buffered bytes, wont: at most %d", len(body.buf), 64<<10)
+	}
+	body.mu.Unlock()
+
+	fast.Body.Close()
+	slow.Body.Close()
+}
+
+func TestCoalesce_ReleaseReadChunks(t *testing.T) {
+	const size = 1 << 20
+	bt := &blockingTransport{release: make(chan struct{}), body: bytes.Repeat([]byte("x"), size)}
+	close(bt.release)
+	ct := buildCoalesceTransport(bt, CoalesceConfig{Enabled: true})
+
+	c := &coalesceCall{t: ct, refs: 2}
+	res, err := bt.RoundTrip(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.res = res
+	r := httptest.NewRequest("GET", "/", nil)
+	a, b := c.bodyFor(r.Context()), c.bodyFor(r.Context())
+
+	// Readers taking turns keep the buffer at about one chunk.
+	p := make([]byte, 1024)
+	var total int
+	for {
+		n, err := io.ReadFull(a, p)
+		if _, berr := io.ReadFull(b, p[:n]); berr != nil && n > 0 {
+			t.Fatal(berr)
+		}
+		total += n
+		shared := a.(*sharedBodyReader).body
+		shared.mu.Lock()
+		if len(shared.buf) > 32*1024 {
+			t.Fatalf("got: %d buffered bytes after both read %d", len(shared.buf), total)
+		}
+		shared.mu.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	if total != size {
+		t.Errorf("got: %d bytes, wont: %d", total, size)
+	}
+}
+
+func TestCoalesce_Private(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		shared bool
+	}{
+		{"set-cookie", http.Header{"Set-Cookie": {"session=alice"}}, false},
+		{"private", http.Header{"Cache-Control": {"max-age=60, private"}}, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false},
+		{"vary", http.Header{"Vary": {"Accept-Language, Accept-Encoding"}}, false},
+		{"vary keyed", http.Header{"Vary": {"accept-language"}}, true},
+		{"public", http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+	}
+
+	for _, tt := range tests {
+		bt := &blockingTransport{release: make(chan struct{}), header: tt.header, body: []byte("hello")}
+		ct := buildCoalesceTransport(bt, CoalesceConfig{Enabled: true, Headers: []string{"Accept-Language"}})
+
+		responses := make(chan *http.Response, 2)
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest("GET", "http://niwa.test/", nil)
+			req := r.WithContext(ct.withKey(r.Context(), r))
+			go func() {
+				res, err := ct.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+				}
+				responses <- res
+			}()
+		}
+		waitForRefs(ct, 2)
+		close(bt.release)
+
+		for i := 0; i < 2; i++ {
+			res := <-responses
+			if res == nil {
+				t.FailNow()
+			}
+			if body, err := io.ReadAll(res.Body); err != nil || string(body) != "hello" {
+				t.Errorf("%s: got: %q %v, wont: hello", tt.name, body, err)
+			}
+			res.Body.Close()
+		}
+
+		wont := int32(2)
+		if tt.shared {
+			wont = 1
+		}
+		if got := bt.calls.Load(); got != wont {
+			t.Errorf("%s: got: %d upstream requests, wont: %d", tt.name, got, wont)
+		}
+	}
+}
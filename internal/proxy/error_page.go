@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type ErrorPage struct {
+	Path     string
+	Template bool
+}
+
+type errorPage struct {
+	body        []byte
+	template    *template.Template
+	contentType string
+}
+
+type errorPageVars struct {
+	Status     int
+	StatusText string
+	Path       string
+	RequestID  string
+	CSPNonce   string
+}
+
+func buildErrorPages(pages map[int]ErrorPage) (map[int]*errorPage, error) {
+	built := map[int]*errorPage{}
+	for status, page := range pages {
+		if status < 400 || status > 599 {
+			return nil, fmt.Errorf("error page status is invalid value: %d", status)
+		}
+
+		body, err := os.ReadFile(filepath.Clean(page.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		ep := &errorPage{body: body, contentType: mime.TypeByExtension(filepath.Ext(page.Path))}
+		if ep.contentType == "" {
+			ep.contentType = "text/html; charset=utf-8"
+		}
+		if page.Template {
+			if ep.template, err = template.New(page.Path).Parse(string(body)); err != nil {
+				return nil, err
+			}
+		}
+		built[status] = ep
+	}
+	return built, nil
+}
+
+// newErrorPageVars takes the request values from the header variables, so
+// pages for upstream failures and for upstream error responses render the
+// same request ID and path.
+func newErrorPageVars(status int, hv *headerVars) errorPageVars {
+	return errorPageVars{Status: status, StatusText: http.StatusText(status), Path: hv.Path, RequestID: hv.RequestID, CSPNonce: hv.CSPNonce}
+}
+
+func (page *errorPage) render(vars errorPageVars) ([]byte, error) {
+	if page.template == nil {
+		return page.body, nil
+	}
+
+	wr := new(bytes.Buffer)
+	if err := page.template.Execute(wr, vars); err != nil {
+		return nil, err
+	}
+	return wr.Bytes(), nil
+}
+
+// buildErrorHandler returns a ReverseProxy.ErrorHandler that maps upstream
+// failures to 502, 503 or 504 and responds with the configured error page.
+func buildErrorHandler(pages map[int]*errorPage, errorLog *log.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		status := upstreamErrorStatus(err)
+		logf(errorLog, "http: proxy error: %v", err)
+
+		page, found := pages[status]
+		if !found {
+			w.WriteHeader(status)
+			return
+		}
+
+		body, err := page.render(newErrorPageVars(status, headerVarsFrom(r.Context())))
+		if err != nil {
+			logf(errorLog, "http: error page render error: %v", err)
+			w.WriteHeader(status)
+			return
+		}
+
+		w.Header().Set("Content-Type", page.contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	}
+}
+
+// applyErrorPage replaces the body of an error response sent by the upstream
+// with the page configured for its status. The upstream body is kept when the
+// page can't be rendered.
+func applyErrorPage(res *http.Response, pages map[int]*errorPage, errorLog *log.Logger) {
+	page, found := pages[res.StatusCode]
+	if !found {
+		return
+	}
+
+	body, err := page.render(newErrorPageVars(res.StatusCode, headerVarsFrom(res.Request.Context())))
+	if err != nil {
+		logf(errorLog, "http: error page render error: %v", err)
+		return
+	}
+
+	_ = res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if res.Request.Method == http.MethodHead {
+		res.Body = http.NoBody
+	}
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	for _, h := range []string{"Content-Encoding", "ETag", "Last-Modified"} {
+		res.Header.Del(h)
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Set("Content-Type", page.contentType)
+	res.Header.Set("Cache-Control", "no-store")
+}
+
+func upstreamErrorStatus(err error) int {
+	switch classifyError(err) {
+	case "timeout":
+		return http.StatusGatewayTimeout
+	case "connect":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func logf(l *log.Logger, format string, args ...any) {
+	if l != nil {
+		l.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"strings"
+	"text/template"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+	"github.com/y-yagi/niwa/internal/secheaders"
+)
+
+type HeaderRules struct {
+	Set     []HeaderValue
+	Add     []HeaderValue
+	Remove  []string
+	Replace []HeaderReplace
+}
+
+type HeaderValue struct {
+	Key   string
+	Value string
+}
+
+type HeaderReplace struct {
+	Key string
+	Old string
+	New string
+}
+
+// headerVars are the variables available in header value templates.
+type headerVars struct {
+	ClientIP  string
+	RequestID string
+	Host      string
+	Method    string
+	Path      string
+	Scheme    string
+	CSPNonce  string
+}
+
+type headerVarsKey struct{}
+
+type headerTemplate struct {
+	key   string
+	value *template.Template
+}
+
+type headerRules struct {
+	set     []headerTemplate
+	add     []headerTemplate
+	remove  []string
+	replace []HeaderReplace
+}
+
+func buildHeaderRules(rules HeaderRules) (*headerRules, error) {
+	hr := &headerRules{remove: rules.Remove, replace: rules.Replace}
+
+	var err error
+	if hr.set, err = buildHeaderTemplates(rules.Set); err != nil {
+		return nil, err
+	}
+	if hr.add, err = buildHeaderTemplates(rules.Add); err != nil {
+		return nil, err
+	}
+
+	return hr, nil
+}
+
+func buildHeaderTemplates(values []HeaderValue) ([]headerTemplate, error) {
+	var templates []headerTemplate
+	for _, v := range values {
+		t, err := template.New(v.Key).Parse(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, headerTemplate{key: v.Key, value: t})
+	}
+	return templates, nil
+}
+
+func (hr *headerRules) apply(h http.Header, vars *headerVars) {
+	if hr == nil {
+		return
+	}
+
+	for _, key := range hr.remove {
+		h.Del(key)
+	}
+	for _, t := range hr.set {
+		h.Set(t.key, t.render(vars))
+	}
+	for _, t := range hr.add {
+		h.Add(t.key, t.render(vars))
+	}
+	for _, r := range hr.replace {
+		values := h.Values(r.Key)
+		for i, v := range values {
+			values[i] = strings.ReplaceAll(v, r.Old, r.New)
+		}
+	}
+}
+
+func (t *headerTemplate) render(vars *headerVars) string {
+	wr := new(bytes.Buffer)
+	if err := t.value.Execute(wr, vars); err != nil {
+		return ""
+	}
+	return wr.String()
+}
+
+// newHeaderVars takes the client IP from X-Forwarded-For when the peer is one
+// of trustedProxies, like rate limiting and IP filtering do.
+func newHeaderVars(r *http.Request, trustedProxies []netip.Prefix) *headerVars {
+	var clientIP string
+	if addr, err := clientip.FromRequest(r, trustedProxies); err == nil {
+		clientIP = addr.String()
+	} else {
+		clientIP = r.RemoteAddr
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	return &headerVars{ClientIP: clientIP, RequestID: requestID, Host: r.Host, Method: r.Method, Path: r.URL.Path, Scheme: scheme, CSPNonce: secheaders.Nonce(r.Context())}
+}
+
+func withHeaderVars(ctx context.Context, vars *headerVars) context.Context {
+	return context.WithValue(ctx, headerVarsKey{}, vars)
+}
+
+func headerVarsFrom(ctx context.Context) *headerVars {
+	vars, _ := ctx.Value(headerVarsKey{}).(*headerVars)
+	if vars == nil {
+		return &headerVars{}
+	}
+	return vars
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
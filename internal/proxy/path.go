@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type PathRewrite struct {
+	Regex       string
+	Replacement string
+}
+
+type pathRewrite struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+type pathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rewrites    []pathRewrite
+	upstreams   *upstreams
+}
+
+func buildPathRewriter(proxyconfig *ProxyConfig, upstreams *upstreams) (*pathRewriter, error) {
+	pr := &pathRewriter{
+		stripPrefix: strings.TrimSuffix(proxyconfig.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(proxyconfig.AddPrefix, "/"),
+		upstreams:   upstreams,
+	}
+
+	for _, r := range proxyconfig.Rewrites {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, err
+		}
+		pr.rewrites = append(pr.rewrites, pathRewrite{regex: re, replacement: r.Replacement})
+	}
+
+	return pr, nil
+}
+
+// rewrite maps the downstream path to the upstream one. The target path is
+// joined afterwards by httputil.ProxyRequest.SetURL.
+func (pr *pathRewriter) rewrite(u *url.URL) {
+	p := u.Path
+	if pr.stripPrefix != "" && hasPathPrefix(p, pr.stripPrefix) {
+		p = strings.TrimPrefix(p, pr.stripPrefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+
+	for _, r := range pr.rewrites {
+		p = r.regex.ReplaceAllString(p, r.replacement)
+	}
+
+	if pr.addPrefix != "" {
+		p = pr.addPrefix + p
+	}
+
+	if p != u.Path {
+		u.Path = p
+		u.RawPath = ""
+	}
+}
+
+// reverse maps an upstream path back to the downstream one. Only the prefix
+// options can be reversed; regex rewrites are left as they are.
+func (pr *pathRewriter) reverse(p string) string {
+	if pr.stripPrefix == "" && pr.addPrefix == "" {
+		return p
+	}
+
+	// Upstreams are expected to share the same base path.
+	upstream := strings.TrimSuffix(pr.upstreams.targets[0].Path, "/") + pr.addPrefix
+	if upstream != "" {
+		if !hasPathPrefix(p, upstream) {
+			return p
+		}
+		p = strings.TrimPrefix(p, upstream)
+	}
+
+	if pr.stripPrefix != "" {
+		if p == "/" {
+			p = ""
+		}
+		p = pr.stripPrefix + p
+	}
+
+	if p == "" {
+		p = "/"
+	}
+	return p
+}
+
+func (pr *pathRewriter) rewriteResponse(res *http.Response) {
+	if pr.stripPrefix == "" && pr.addPrefix == "" {
+		return
+	}
+
+	if location := res.Header.Get("Location"); location != "" {
+		res.Header.Set("Location", pr.reverseLocation(location))
+	}
+
+	cookies := res.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = pr.reverseCookiePath(cookie)
+	}
+}
+
+func (pr *pathRewriter) reverseLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	// Absolute redirects to the upstream itself become host-relative so the
+	// client stays on niwa.
+	if u.IsAbs() {
+		if !pr.upstreams.isTarget(u.Host) {
+			return location
+		}
+		u.Scheme = ""
+		u.Host = ""
+		u.User = nil
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+
+	u.Path = pr.reverse(u.Path)
+	u.RawPath = ""
+	return u.String()
+}
+
+func (pr *pathRewriter) reverseCookiePath(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	// The first attribute is the cookie's name and value.
+	for i := 1; i < len(attrs); i++ {
+		k, v, found := strings.Cut(strings.TrimSpace(attrs[i]), "=")
+		if found && strings.EqualFold(k, "path") {
+			attrs[i] = " " + k + "=" + pr.reverse(v)
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
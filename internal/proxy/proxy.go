@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/cache"
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+type ProxyConfig struct {
+	URL             string
+	PreserveHost    bool
+	TrustedProxies  []netip.Prefix
+	ErrorLog        *log.Logger
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+	StripPrefix     string
+	AddPrefix       string
+	Rewrites        []PathRewrite
+	Upstreams       []string
+	Retry           RetryPolicy
+	Transport       http.RoundTripper
+	TransportConfig TransportConfig
+	ErrorPages      map[int]ErrorPage
+	FlushInterval   time.Duration
+	Cache           *cache.Cache
+	Coalesce        CoalesceConfig
+}
+
+func New(proxyconfig *ProxyConfig) (*httputil.ReverseProxy, error) {
+	upstreams, err := buildUpstreams(proxyconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := proxyconfig.Transport
+	if transport == nil {
+		if transport, err = buildTransport(proxyconfig.TransportConfig, upstreams.sockets); err != nil {
+			return nil, err
+		}
+	}
+	if transport, err = buildRetryTransport(transport, upstreams, proxyconfig.Retry); err != nil {
+		return nil, err
+	}
+	// Coalescing sits below the cache, so concurrent misses share one request.
+	coalescer := buildCoalesceTransport(transport, proxyconfig.Coalesce)
+	if coalescer != nil {
+		transport = coalescer
+	}
+	if proxyconfig.Cache != nil {
+		transport = proxyconfig.Cache.Transport(transport)
+	}
+
+	pathRewriter, err := buildPathRewriter(proxyconfig, upstreams)
+	if err != nil {
+		return nil, err
+	}
+	requestHeaders, err := buildHeaderRules(proxyconfig.RequestHeaders)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaders, err := buildHeaderRules(proxyconfig.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPages, err := buildErrorPages(proxyconfig.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pathRewriter.rewrite(pr.Out.URL)
+			upstreams.setURL(pr, proxyconfig.PreserveHost)
+			setForwarded(pr, clientip.IsTrusted(pr.In.RemoteAddr, proxyconfig.TrustedProxies))
+
+			vars := newHeaderVars(pr.In, proxyconfig.TrustedProxies)
+			requestHeaders.apply(pr.Out.Header, vars)
+			ctx := withHeaderVars(pr.Out.Context(), vars)
+			if proxyconfig.Cache != nil {
+				ctx = cache.WithKey(ctx, cache.Key(pr.In))
+			}
+			if coalescer != nil {
+				ctx = coalescer.withKey(ctx, pr.In)
+			}
+			pr.Out = pr.Out.WithContext(ctx)
+		},
+		ModifyResponse: func(res *http.Response) error {
+			pathRewriter.rewriteResponse(res)
+			responseHeaders.apply(res.Header, headerVarsFrom(res.Request.Context()))
+			applyErrorPage(res, errorPages, proxyconfig.ErrorLog)
+			return nil
+		},
+		ErrorHandler:  buildErrorHandler(errorPages, proxyconfig.ErrorLog),
+		Transport:     transport,
+		FlushInterval: proxyconfig.FlushInterval,
+		ErrorLog:      proxyconfig.ErrorLog,
+	}
+
+	return rp, nil
+}
+
+// setForwarded sets X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and
+// Forwarded (RFC 7239) on the outbound request. Values sent by the client are
+// only kept when the peer is a trusted proxy.
+func setForwarded(pr *httputil.ProxyRequest, trusted bool) {
+	inProto := "http"
+	if pr.In.TLS != nil {
+		inProto = "https"
+	}
+	proto, host := inProto, pr.In.Host
+	clientIP, _, err := net.SplitHostPort(pr.In.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+
+	// Rewrite already removed X-Forwarded-* from the outbound request.
+	pr.Out.Header.Del("Forwarded")
+
+	xff := clientIP
+	if trusted {
+		if prior := pr.In.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			xff = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		if h := pr.In.Header.Get("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+		if p := pr.In.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	}
+
+	if xff != "" {
+		pr.Out.Header.Set("X-Forwarded-For", xff)
+	}
+	pr.Out.Header.Set("X-Forwarded-Host", host)
+	pr.Out.Header.Set("X-Forwarded-Proto", proto)
+
+	forwarded := forwardedElement(clientIP, pr.In.Host, inProto)
+	if trusted {
+		if prior := pr.In.Header.Values("Forwarded"); len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+	}
+	pr.Out.Header.Set("Forwarded", forwarded)
+}
+
+func forwardedElement(clientIP, host, proto string) string {
+	var pairs []string
+	if clientIP != "" {
+		if strings.Contains(clientIP, ":") {
+			pairs = append(pairs, `for="[`+clientIP+`]"`)
+		} else {
+			pairs = append(pairs, "for="+clientIP)
+		}
+	}
+	if host != "" {
+		pairs = append(pairs, "host="+quoteForwarded(host))
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// quoteForwarded quotes values that aren't a valid RFC 7230 token, such as
+// "host:port".
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && !('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
@@ -0,0 +1,787 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/cache"
+	"github.com/y-yagi/niwa/internal/proxy"
+	"github.com/y-yagi/niwa/internal/secheaders"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newUpstream(t *testing.T, got *http.Request) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = *r.Clone(r.Context())
+	}))
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	var got http.Request
+	as := newUpstream(t, &got)
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://niwa.test/app", nil)
+	req.RemoteAddr = "203.0.113.10:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=198.51.100.1")
+	rp.ServeHTTP(httptest.NewRecorder(), req)
+
+	wonts := map[string]string{
+		"X-Forwarded-For":   "203.0.113.10",
+		"X-Forwarded-Host":  "niwa.test",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         "for=203.0.113.10;host=niwa.test;proto=http",
+	}
+	for k, wont := range wonts {
+		if got.Header.Get(k) != wont {
+			t.Errorf("%s got: %s, wont: %s", k, got.Header.Get(k), wont)
+		}
+	}
+
+	if got.Host == "niwa.test" {
+		t.Errorf("expected the upstream host is used, but got: %s", got.Host)
+	}
+}
+
+func TestForwardedHeaders_TrustedProxy(t *testing.T) {
+	var got http.Request
+	as := newUpstream(t, &got)
+	defer as.Close()
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, TrustedProxies: trusted, PreserveHost: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://niwa.test:8080/app", nil)
+	req.RemoteAddr = "203.0.113.10:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("Forwarded", "for=198.51.100.1;proto=https")
+	rp.ServeHTTP(httptest.NewRecorder(), req)
+
+	wonts := map[string]string{
+		"X-Forwarded-For":   "198.51.100.1, 203.0.113.10",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         `for=198.51.100.1;proto=https, for=203.0.113.10;host="niwa.test:8080";proto=http`,
+	}
+	for k, wont := range wonts {
+		if got.Header.Get(k) != wont {
+			t.Errorf("%s got: %s, wont: %s", k, got.Header.Get(k), wont)
+		}
+	}
+
+	if got.Host != "niwa.test:8080" {
+		t.Errorf("got: %s, wont: %s", got.Host, "niwa.test:8080")
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	var got http.Request
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *r.Clone(r.Context())
+		w.Header().Set("Server", "app")
+		w.Header().Set("Location", "http://internal.test/login")
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	defer as.Close()
+
+	proxyconfig := &proxy.ProxyConfig{
+		URL: as.URL,
+		RequestHeaders: proxy.HeaderRules{
+			Set:    []proxy.HeaderValue{{Key: "X-Real-IP", Value: "{{.ClientIP}}"}, {Key: "X-Request-Id", Value: "{{.RequestID}}"}},
+			Add:    []proxy.HeaderValue{{Key: "X-Via", Value: "niwa"}},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: proxy.HeaderRules{
+			Set:     []proxy.HeaderValue{{Key: "X-Frame-Options", Value: "DENY"}, {Key: "X-Request-Id", Value: "{{.RequestID}}"}},
+			Remove:  []string{"Server"},
+			Replace: []proxy.HeaderReplace{{Key: "Location", Old: "http://internal.test", New: "https://niwa.test"}},
+		},
+	}
+	rp, err := proxy.New(proxyconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://niwa.test/app", nil)
+	req.RemoteAddr = "203.0.113.10:1234"
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Via", "client")
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, req)
+
+	if got.Header.Get("X-Real-IP") != "203.0.113.10" {
+		t.Errorf("got: %s, wont: %s", got.Header.Get("X-Real-IP"), "203.0.113.10")
+	}
+	if got.Header.Get("Cookie") != "" {
+		t.Errorf("expected Cookie is removed, but got: %s", got.Header.Get("Cookie"))
+	}
+	if len(got.Header.Values("X-Via")) != 2 {
+		t.Errorf("got: %v, wont: %v", got.Header.Values("X-Via"), []string{"client", "niwa"})
+	}
+
+	res := w.Result()
+	if res.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("got: %s, wont: %s", res.Header.Get("X-Frame-Options"), "DENY")
+	}
+	if res.Header.Get("Server") != "" {
+		t.Errorf("expected Server is removed, but got: %s", res.Header.Get("Server"))
+	}
+	if res.Header.Get("Location") != "https://niwa.test/login" {
+		t.Errorf("got: %s, wont: %s", res.Header.Get("Location"), "https://niwa.test/login")
+	}
+	if id := res.Header.Get("X-Request-Id"); id == "" || id != got.Header.Get("X-Request-Id") {
+		t.Errorf("expected same request id, but got: %s and %s", id, got.Header.Get("X-Request-Id"))
+	}
+
+	// Behind a trusted proxy, the client is taken from X-Forwarded-For.
+	proxyconfig.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	trp, err := proxy.New(proxyconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treq := httptest.NewRequest("GET", "http://niwa.test/app", nil)
+	treq.RemoteAddr = "10.0.0.2:1234"
+	treq.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.3")
+	trp.ServeHTTP(httptest.NewRecorder(), treq)
+	if got.Header.Get("X-Real-IP") != "198.51.100.7" {
+		t.Errorf("got: %s, wont: %s", got.Header.Get("X-Real-IP"), "198.51.100.7")
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	var got http.Request
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *r.Clone(r.Context())
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/v1/account"})
+		http.SetCookie(w, &http.Cookie{Name: "path", Value: "/v1/keep", Path: "/v1/account"})
+		http.Redirect(w, r, "/v1/login?next=%2F", http.StatusFound)
+	}))
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, StripPrefix: "/app", AddPrefix: "/v1", Rewrites: []proxy.PathRewrite{{Regex: "^/old/(.*)$", Replacement: "/new/$1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		wont   string
+	}{
+		{"http://niwa.test/app/users?id=1", "/v1/users"},
+		{"http://niwa.test/app", "/v1/"},
+		{"http://niwa.test/app/old/page", "/v1/new/page"},
+		{"http://niwa.test/application", "/v1/application"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+
+		if got.URL.Path != tt.wont {
+			t.Errorf("%s: got: %s, wont: %s", tt.target, got.URL.Path, tt.wont)
+		}
+
+		res := w.Result()
+		if res.Header.Get("Location") != "/app/login?next=%2F" {
+			t.Errorf("got: %s, wont: %s", res.Header.Get("Location"), "/app/login?next=%2F")
+		}
+		cookies := res.Header.Values("Set-Cookie")
+		if len(cookies) != 2 || cookies[0] != "session=1; Path=/app/account" || cookies[1] != "path=/v1/keep; Path=/app/account" {
+			t.Errorf("got: %v, wont: %v", cookies, []string{"session=1; Path=/app/account", "path=/v1/keep; Path=/app/account"})
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var hits atomic.Int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "ok %s %s", r.URL.Path, body)
+	}))
+	defer ok.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{Upstreams: []string{unavailable.URL, down.URL, ok.URL}, Retry: proxy.RetryPolicy{MaxAttempts: 3, MaxBodyBuffer: 1024, NonIdempotent: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/app", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "ok /app " {
+			t.Errorf("got: %d %s, wont: %d %s", w.Code, w.Body.String(), http.StatusOK, "ok /app ")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("POST", "http://niwa.test/app", strings.NewReader("body")))
+	if w.Code != http.StatusOK || w.Body.String() != "ok /app body" {
+		t.Errorf("got: %d %s, wont: %d %s", w.Code, w.Body.String(), http.StatusOK, "ok /app body")
+	}
+
+	if hits.Load() == 0 {
+		t.Errorf("expected the unavailable upstream was tried")
+	}
+}
+
+func TestRetry_NonIdempotent(t *testing.T) {
+	var hits atomic.Int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: unavailable.URL, Retry: proxy.RetryPolicy{MaxAttempts: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("POST", "http://niwa.test/app", strings.NewReader("body")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("got: %d, wont: %d", hits.Load(), 1)
+	}
+
+	w = httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("DELETE", "http://niwa.test/app", nil))
+	if hits.Load() != 4 {
+		t.Errorf("got: %d, wont: %d", hits.Load(), 4)
+	}
+
+	// A buffered body alone doesn't make POST retryable.
+	rp, err = proxy.New(&proxy.ProxyConfig{URL: unavailable.URL, Retry: proxy.RetryPolicy{MaxAttempts: 3, MaxBodyBuffer: 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://niwa.test/app", strings.NewReader("body")))
+	if hits.Load() != 5 {
+		t.Errorf("got: %d, wont: %d", hits.Load(), 5)
+	}
+}
+
+func TestRetry_PerTryTimeout(t *testing.T) {
+	var hits atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer slow.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: slow.URL, Retry: proxy.RetryPolicy{MaxAttempts: 2, PerTryTimeout: 20 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("got: %d %s, wont: %d %s", w.Code, w.Body.String(), http.StatusOK, "ok")
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	pages := map[int]proxy.ErrorPage{http.StatusServiceUnavailable: {Path: "../../testdata/error.html", Template: true}}
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: down.URL, ErrorPages: pages, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	wont := "<h1>503 Service Unavailable</h1>\n"
+	if w.Body.String() != wont {
+		t.Errorf("got: %s, wont: %s", w.Body.String(), wont)
+	}
+
+	if w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("got: %s, wont: %s", w.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	}
+}
+
+func TestErrorPages_UpstreamStatus(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"upstream"`)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, "upstream body")
+	}))
+	defer as.Close()
+
+	pages := map[int]proxy.ErrorPage{http.StatusNotFound: {Path: "../../testdata/error.html", Template: true}}
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, ErrorPages: pages, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/missing", nil))
+
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>404 Not Found</h1>\n" {
+		t.Errorf("got: %d %s, wont: the 404 page", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/html; charset=utf-8" || w.Header().Get("ETag") != "" {
+		t.Errorf("got headers: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/broken", nil))
+
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "upstream body" {
+		t.Errorf("got: %d %s, wont: the upstream response", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorPages_RequestIDAndHead(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer as.Close()
+
+	page := path.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(page, []byte(`{{.Status}} {{.RequestID}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pages := map[int]proxy.ErrorPage{http.StatusServiceUnavailable: {Path: page, Template: true}, http.StatusNotFound: {Path: page, Template: true}}
+
+	for _, url := range []string{down.URL, as.URL} {
+		rp, err := proxy.New(&proxy.ProxyConfig{URL: url, ErrorPages: pages, ErrorLog: log.New(io.Discard, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+		status, id, _ := strings.Cut(w.Body.String(), " ")
+		if status != strconv.Itoa(w.Code) || len(id) == 0 {
+			t.Errorf("got: %d %q, wont: a generated request ID", w.Code, w.Body.String())
+		}
+
+		r := httptest.NewRequest("GET", "http://niwa.test/", nil)
+		r.Header.Set("X-Request-Id", "abc")
+		w = httptest.NewRecorder()
+		rp.ServeHTTP(w, r)
+		if got := w.Body.String(); got != strconv.Itoa(w.Code)+" abc" {
+			t.Errorf("got: %q, wont: the incoming request ID", got)
+		}
+
+		w = httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("HEAD", "http://niwa.test/", nil))
+		if w.Code < 400 || w.Body.Len() != 0 {
+			t.Errorf("got: %d %q, wont: an error without a body", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestErrorPages_InvalidStatus(t *testing.T) {
+	pages := map[int]proxy.ErrorPage{http.StatusOK: {Path: "../../testdata/error.html"}}
+	if _, err := proxy.New(&proxy.ProxyConfig{URL: "http://localhost", ErrorPages: pages}); err == nil {
+		t.Error("expected an error for a non-error status")
+	}
+}
+
+func TestErrorPages_CSPNonce(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	page := path.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(page, []byte(`<script nonce="{{.CSPNonce}}"></script>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := map[int]proxy.ErrorPage{http.StatusServiceUnavailable: {Path: page, Template: true}}
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: down.URL, ErrorPages: pages, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := secheaders.New(&secheaders.SecurityHeadersConfig{Preset: "strict", CSPNonce: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nonces are random, so check enough of them to cover every character
+	// html/template would escape in an attribute.
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		s.Handler(rp).ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+
+		body := w.Body.String()
+		nonce := strings.TrimSuffix(strings.TrimPrefix(body, `<script nonce="`), `"></script>`)
+		if len(nonce) == 0 || nonce == body {
+			t.Fatalf("got: %s, wont: a nonce", body)
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "'nonce-"+nonce+"'") {
+			t.Fatalf("got: %s, wont: the nonce %s", csp, nonce)
+		}
+	}
+}
+
+func TestErrorPages_GatewayTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: slow.URL, Retry: proxy.RetryPolicy{MaxAttempts: 2, PerTryTimeout: 10 * time.Millisecond}, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got: %d, wont: %d", w.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestTransport_TLS(t *testing.T) {
+	as := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.TLS.ServerName)
+	}))
+	as.EnableHTTP2 = true
+	as.Config.ErrorLog = log.New(io.Discard, "", 0)
+	as.StartTLS()
+	defer as.Close()
+
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cafile := path.Join(tempDir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: as.Certificate().Raw})
+	if err := os.WriteFile(cafile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		transport proxy.TransportConfig
+		status    int
+		body      string
+	}{
+		{proxy.TransportConfig{TLS: proxy.TLSConfig{CAFile: cafile, ServerName: "example.com"}}, http.StatusOK, "HTTP/2.0 example.com"},
+		{proxy.TransportConfig{TLS: proxy.TLSConfig{CAFile: cafile, ServerName: "example.com"}, DisableHTTP2: true}, http.StatusOK, "HTTP/1.1 example.com"},
+		{proxy.TransportConfig{TLS: proxy.TLSConfig{InsecureSkipVerify: true, ServerName: "niwa.test"}}, http.StatusOK, "HTTP/2.0 niwa.test"},
+		{proxy.TransportConfig{MaxIdleConns: 10}, http.StatusBadGateway, ""},
+	}
+
+	for _, tt := range tests {
+		rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, TransportConfig: tt.transport, ErrorLog: log.New(io.Discard, "", 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%+v: got: %d %s, wont: %d %s", tt.transport, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+func TestTransport_H2C(t *testing.T) {
+	as := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), &http2.Server{}))
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, TransportConfig: proxy.TransportConfig{H2C: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/", nil))
+
+	if w.Body.String() != "HTTP/2.0" {
+		t.Errorf("got: %s, wont: %s", w.Body.String(), "HTTP/2.0")
+	}
+
+	invalid := []proxy.TransportConfig{
+		{H2C: true, ResponseHeaderTimeout: time.Second},
+		{H2C: true, MaxIdleConns: 10},
+		{H2C: true, TLS: proxy.TLSConfig{InsecureSkipVerify: true}},
+	}
+	for _, tc := range invalid {
+		if _, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, TransportConfig: tc}); err == nil {
+			t.Errorf("%+v: expected an error for an option h2c ignores", tc)
+		}
+	}
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	socket := path.Join(t.TempDir(), "upstream.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got http.Request
+	as := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *r
+		fmt.Fprint(w, "from socket")
+	}))
+	as.Listener = l
+	as.Start()
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: "unix:" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://niwa.test/users?page=2", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "from socket" {
+		t.Fatalf("got: %d %s, wont: %d %s", w.Code, w.Body.String(), http.StatusOK, "from socket")
+	}
+	if got.URL.String() != "/users?page=2" {
+		t.Errorf("got: %s, wont: %s", got.URL.String(), "/users?page=2")
+	}
+	if got.Host != "localhost" {
+		t.Errorf("got: %s, wont: %s", got.Host, "localhost")
+	}
+}
+
+func TestCache(t *testing.T) {
+	var hits atomic.Int32
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "%s %d", r.URL.Path, hits.Add(1))
+	}))
+	defer as.Close()
+
+	c, err := cache.New(&cache.CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url    string
+		status string
+		body   string
+	}{
+		{url: "http://a.test/page", status: "MISS", body: "/page 1"},
+		{url: "http://a.test/page", status: "HIT", body: "/page 1"},
+		{url: "http://b.test/page", status: "MISS", body: "/page 2"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+
+		if got := w.Header().Get(cache.StatusHeader); got != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: got: %s %s, wont: %s %s", tt.url, got, w.Body.String(), tt.status, tt.body)
+		}
+	}
+
+	// Unsafe methods invalidate the stored response.
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("POST", "http://a.test/page", nil))
+	w = httptest.NewRecorder()
+	rp.ServeHTTP(w, httptest.NewRequest("GET", "http://a.test/page", nil))
+	if got := w.Header().Get(cache.StatusHeader); got != "MISS" {
+		t.Errorf("got: %s, wont: MISS", got)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("Accept-Language"))
+	}))
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, Coalesce: proxy.CoalesceConfig{Enabled: true, Headers: []string{"Accept-Language"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lang   string
+		cancel bool
+		body   string
+	}{
+		{lang: "en", body: "/page en"},
+		{lang: "en", body: "/page en"},
+		{lang: "en", cancel: true},
+		{lang: "en", body: "/page en"},
+		{lang: "ja", body: "/page ja"},
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, len(tests))
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "http://niwa.test/page", nil)
+		req.Header.Set("Accept-Language", tt.lang)
+		ctx, cancel := context.WithCancel(req.Context())
+		if tt.cancel {
+			cancel()
+		} else {
+			defer cancel()
+		}
+
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			rp.ServeHTTP(w, req)
+			bodies[i] = w.Body.String()
+		}(i, req.WithContext(ctx))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, tt := range tests {
+		if !tt.cancel && bodies[i] != tt.body {
+			t.Errorf("#%d: got: %s, wont: %s", i, bodies[i], tt.body)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("got: %d upstream requests, wont: 2", hits.Load())
+	}
+}
+
+func TestCoalesce_Streaming(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "second\n")
+	}))
+	defer as.Close()
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, FlushInterval: -1, Coalesce: proxy.CoalesceConfig{Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(rp)
+	defer ps.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	firsts := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(ps.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer res.Body.Close()
+
+			br := bufio.NewReader(res.Body)
+			line, err := br.ReadString('\n')
+			if err != nil {
+				errs <- err
+				return
+			}
+			firsts <- line
+			rest, _ := io.ReadAll(br)
+			if string(rest) != "second\n" {
+				errs <- fmt.Errorf("got: %q, wont: %q", rest, "second\n")
+			}
+		}()
+	}
+
+	// Both clients see the first chunk while the upstream is still writing.
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-firsts:
+			if line != "first\n" {
+				t.Errorf("got: %q, wont: %q", line, "first\n")
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("first chunk was not streamed")
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("got: %d upstream requests, wont: 1", hits.Load())
+	}
+}
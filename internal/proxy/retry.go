@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts   int
+	Statuses      []int
+	Errors        []string
+	Backoff       time.Duration
+	PerTryTimeout time.Duration
+	MaxBodyBuffer int64
+	// NonIdempotent allows retrying methods like POST and PATCH, whose
+	// requests may have had an effect upstream before failing.
+	NonIdempotent bool
+}
+
+// maxRetryBackoff caps the exponential backoff between attempts.
+const maxRetryBackoff = 30 * time.Second
+
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+var retryErrorClasses = []string{"connect", "timeout", "reset"}
+
+// retryTransport resends failed requests, moving to the next upstream on
+// every attempt.
+type retryTransport struct {
+	base      http.RoundTripper
+	upstreams *upstreams
+	policy    RetryPolicy
+	statuses  map[int]bool
+	errors    map[string]bool
+}
+
+func buildRetryTransport(base http.RoundTripper, u *upstreams, policy RetryPolicy) (http.RoundTripper, error) {
+	if policy.MaxAttempts <= 1 {
+		return base, nil
+	}
+
+	rt := &retryTransport{base: base, upstreams: u, policy: policy, statuses: map[int]bool{}, errors: map[string]bool{}}
+
+	statuses := policy.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	for _, status := range statuses {
+		rt.statuses[status] = true
+	}
+
+	classes := policy.Errors
+	if len(classes) == 0 {
+		classes = retryErrorClasses
+	}
+	for _, class := range classes {
+		if !slices.Contains(retryErrorClasses, class) {
+			return nil, fmt.Errorf("retry error is invalid value: %s", class)
+		}
+		rt.errors[class] = true
+	}
+
+	return rt, nil
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Upgraded connections outlive the round trip and can't be replayed.
+	if req.Header.Get("Upgrade") != "" {
+		return rt.base.RoundTrip(req)
+	}
+	if !rt.replayable(req) {
+		return rt.roundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(req.Context())
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if attempt > 0 {
+			rt.upstreams.retarget(r, attempt)
+		}
+
+		res, err := rt.roundTrip(r)
+		last := attempt+1 >= rt.policy.MaxAttempts
+		if last || !rt.retryable(req, res, err) {
+			return res, err
+		}
+
+		if res != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+
+		if !rt.wait(req.Context(), attempt) {
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// replayable reports whether the request can be sent again: idempotent
+// methods, or any method when NonIdempotent is set, whose body, if any, fits
+// in the buffer.
+func (rt *retryTransport) replayable(req *http.Request) bool {
+	if !isIdempotent(req.Method) && !rt.policy.NonIdempotent {
+		return false
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+	if !hasBody {
+		return true
+	}
+	return req.ContentLength > 0 && req.ContentLength <= rt.policy.MaxBodyBuffer
+}
+
+func (rt *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if rt.policy.PerTryTimeout == 0 {
+		return rt.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), rt.policy.PerTryTimeout)
+	res, err := rt.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The timeout covers the whole response, so cancel only once the body is done.
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+func (rt *retryTransport) retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return rt.errors[classifyError(err)]
+	}
+	return rt.statuses[res.StatusCode]
+}
+
+func (rt *retryTransport) wait(ctx context.Context, attempt int) bool {
+	if rt.policy.Backoff == 0 {
+		return true
+	}
+
+	t := time.NewTimer(rt.backoff(attempt))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// backoff doubles the base backoff for every attempt, up to maxRetryBackoff.
+func (rt *retryTransport) backoff(attempt int) time.Duration {
+	d := rt.policy.Backoff
+	for i := 0; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+func classifyError(err error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return "timeout"
+		}
+		return "connect"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return ""
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
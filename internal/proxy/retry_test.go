@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	rt := &retryTransport{policy: RetryPolicy{Backoff: 100 * time.Millisecond}}
+
+	tests := []struct {
+		attempt int
+		wont    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{100, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := rt.backoff(tt.attempt); got != tt.wont {
+			t.Errorf("attempt %d: got: %v, wont: %v", tt.attempt, got, tt.wont)
+		}
+	}
+}
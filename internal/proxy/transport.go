@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type TransportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	ResponseHeaderTimeout time.Duration
+	// DisableHTTP2 stops negotiating HTTP/2 with TLS upstreams.
+	DisableHTTP2 bool
+	// H2C speaks HTTP/2 over cleartext. Only the dial, keepalive and idle
+	// timeouts apply to it.
+	H2C bool
+	TLS TLSConfig
+}
+
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// buildTransport returns http.DefaultTransport unless something is tuned or a
+// unix socket has to be dialed, so plain upstreams keep sharing one
+// connection pool. sockets maps "host:port" to a unix socket path.
+func buildTransport(tc TransportConfig, sockets map[string]string) (http.RoundTripper, error) {
+	if tc == (TransportConfig{}) && len(sockets) == 0 {
+		return http.DefaultTransport, nil
+	}
+
+	tlsConfig, err := buildUpstreamTLSConfig(tc.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAlive}
+	if tc.DialTimeout != 0 {
+		dialer.Timeout = tc.DialTimeout
+	}
+	if tc.KeepAlive != 0 {
+		dialer.KeepAlive = tc.KeepAlive
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket, found := sockets[addr]; found {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if tc.H2C {
+		if err := validateH2C(tc); err != nil {
+			return nil, err
+		}
+		// HTTP/2 over cleartext needs the x/net transport; net/http only
+		// speaks HTTP/2 over TLS here.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: tc.IdleConnTimeout,
+		}, nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dial
+	t.TLSClientConfig = tlsConfig
+	// With a custom TLS config, HTTP/2 is only negotiated when forced.
+	t.ForceAttemptHTTP2 = !tc.DisableHTTP2
+	if tc.MaxIdleConns != 0 {
+		t.MaxIdleConns = tc.MaxIdleConns
+	}
+	if tc.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+	if tc.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = tc.IdleConnTimeout
+	}
+	t.ResponseHeaderTimeout = tc.ResponseHeaderTimeout
+
+	return t, nil
+}
+
+// validateH2C rejects the options the x/net transport has no equivalent for,
+// rather than dropping them silently.
+func validateH2C(tc TransportConfig) error {
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"max_idle_conns", tc.MaxIdleConns != 0},
+		{"max_idle_conns_per_host", tc.MaxIdleConnsPerHost != 0},
+		{"response_header_timeout", tc.ResponseHeaderTimeout != 0},
+		{"http2", tc.DisableHTTP2},
+		{"tls", tc.TLS != (TLSConfig{})},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return errors.New("h2c can't be used with " + u.name)
+		}
+	}
+	return nil
+}
+
+func buildUpstreamTLSConfig(tc TLSConfig) (*tls.Config, error) {
+	/* #nosec G402 */
+	tlsConfig := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if tc.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(tc.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate is found in " + tc.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
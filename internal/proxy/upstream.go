@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// upstreams picks targets in round-robin order. A "unix:/path/to.sock"
+// upstream gets a placeholder host that the transport dials as the socket.
+type upstreams struct {
+	targets []*url.URL
+	sockets map[string]string
+	next    atomic.Uint64
+}
+
+// upstreamRequest keeps what is needed to send the same request to another
+// target: the URL before a target was joined, the Host header of the
+// outbound request and the index of the target used first.
+type upstreamRequest struct {
+	url          *url.URL
+	host         string
+	preserveHost bool
+	index        int
+}
+
+type upstreamRequestKey struct{}
+
+func buildUpstreams(proxyconfig *ProxyConfig) (*upstreams, error) {
+	var rawurls []string
+	if proxyconfig.URL != "" {
+		rawurls = append(rawurls, proxyconfig.URL)
+	}
+	rawurls = append(rawurls, proxyconfig.Upstreams...)
+
+	if len(rawurls) == 0 {
+		return nil, errors.New("reverse proxy upstream is missing")
+	}
+
+	u := &upstreams{sockets: map[string]string{}}
+	for i, rawurl := range rawurls {
+		target, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+
+		if target.Scheme == "unix" {
+			socket := target.Opaque
+			if socket == "" {
+				socket = target.Path
+			}
+			if socket == "" {
+				return nil, fmt.Errorf("unix socket path is missing: %s", rawurl)
+			}
+			host := "niwa-unix-" + strconv.Itoa(i)
+			u.sockets[host+":80"] = socket
+			target = &url.URL{Scheme: "http", Host: host}
+		}
+
+		u.targets = append(u.targets, target)
+	}
+	return u, nil
+}
+
+// setURL points the outbound request to the next target and remembers how to
+// retarget it later.
+func (u *upstreams) setURL(pr *httputil.ProxyRequest, preserveHost bool) {
+	index := int((u.next.Add(1) - 1) % uint64(len(u.targets)))
+	original := *pr.Out.URL
+
+	pr.SetURL(u.targets[index])
+	if preserveHost {
+		pr.Out.Host = pr.In.Host
+	}
+	u.setSocketHost(pr.Out)
+
+	ur := &upstreamRequest{url: &original, host: pr.Out.Host, preserveHost: preserveHost, index: index}
+	pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), upstreamRequestKey{}, ur))
+}
+
+// retarget points req to the attempt-th target after the one used first.
+func (u *upstreams) retarget(req *http.Request, attempt int) {
+	ur, ok := req.Context().Value(upstreamRequestKey{}).(*upstreamRequest)
+	if !ok || len(u.targets) == 1 {
+		return
+	}
+
+	out := &httputil.ProxyRequest{Out: req}
+	original := *ur.url
+	req.URL = &original
+	out.SetURL(u.targets[(ur.index+attempt)%len(u.targets)])
+	if ur.preserveHost {
+		req.Host = ur.host
+	}
+	u.setSocketHost(req)
+}
+
+// setSocketHost sends "localhost" as Host to unix socket upstreams instead of
+// the placeholder.
+func (u *upstreams) setSocketHost(req *http.Request) {
+	if req.Host == "" {
+		if _, found := u.sockets[req.URL.Host+":80"]; found {
+			req.Host = "localhost"
+		}
+	}
+}
+
+func (u *upstreams) isTarget(host string) bool {
+	for _, target := range u.targets {
+		if target.Host == host {
+			return true
+		}
+	}
+	return false
+}
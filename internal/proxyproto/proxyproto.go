@@ -0,0 +1,212 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+// Listener reads the HAProxy PROXY protocol (v1 or v2) header that load
+// balancers send before the client's data, so RemoteAddr is the client's
+// address instead of the balancer's. The header is required from trusted
+// peers and not read from others. When trusted is empty, no peer is trusted.
+type Listener struct {
+	net.Listener
+	trusted []netip.Prefix
+	timeout time.Duration
+}
+
+const defaultHeaderTimeout = 10 * time.Second
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest v1 header, including CRLF.
+const v1MaxLength = 107
+
+func NewListener(l net.Listener, trusted []netip.Prefix, timeout time.Duration) *Listener {
+	if timeout == 0 {
+		timeout = defaultHeaderTimeout
+	}
+	return &Listener{Listener: l, trusted: trusted, timeout: timeout}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !clientip.IsTrusted(c.RemoteAddr().String(), l.trusted) {
+		return c, nil
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout}, nil
+}
+
+// Conn reads the header on first use, in the goroutine serving the
+// connection rather than in Accept.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		c.err = err
+		return
+	}
+	defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+
+	prefix, err := c.r.Peek(len(v1Prefix))
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	if bytes.Equal(prefix, v1Prefix) {
+		c.remoteAddr, c.localAddr, c.err = readV1(c.r)
+		return
+	}
+	if prefix, err := c.r.Peek(len(v2Signature)); err == nil && bytes.Equal(prefix, v2Signature) {
+		c.remoteAddr, c.localAddr, c.err = readV2(c.r)
+		return
+	}
+	c.err = errors.New("proxyproto: missing PROXY protocol header")
+}
+
+// readV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n". For UNKNOWN
+// the addresses of the connection are kept.
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxyproto: invalid v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("proxyproto: invalid v1 header")
+	}
+
+	src, err := v1Addr(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func v1Addr(ip, port string, v6 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is6() != v6 {
+		return nil, errors.New("proxyproto: invalid v1 address: " + ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, errors.New("proxyproto: invalid v1 port: " + port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readV2 parses the binary header. LOCAL commands, such as health checks
+// from the balancer, and non-IP families keep the addresses of the
+// connection. TLVs are skipped.
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.New("proxyproto: unsupported v2 version")
+	}
+	command, family := header[12]&0x0f, header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0:
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, errors.New("proxyproto: unsupported v2 command")
+	}
+
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("proxyproto: short v2 address block")
+	}
+
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)), net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
@@ -0,0 +1,116 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/proxyproto"
+)
+
+func startServer(t *testing.T, trusted []netip.Prefix) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.RemoteAddr)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() { _ = server.Serve(proxyproto.NewListener(l, trusted, time.Second)) }()
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+// remoteAddr sends header and a request and returns the RemoteAddr the
+// server saw, or "" when the request was rejected.
+func remoteAddr(t *testing.T, addr string, header []byte) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write(append(header, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"...)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return ""
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func v2Header(command byte, src, dst netip.AddrPort) []byte {
+	family := byte(0x11)
+	if src.Addr().Is6() {
+		family = 0x21
+	}
+	addrs := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	// A TLV that must be skipped.
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0xff)
+
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestListener(t *testing.T) {
+	addr := startServer(t, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	tests := []struct {
+		name   string
+		header []byte
+		wont   string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1:"},
+		{"v2 TCP4", v2Header(1, netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")), "192.0.2.1:56324"},
+		{"v2 TCP6", v2Header(1, netip.MustParseAddrPort("[2001:db8::1]:56324"), netip.MustParseAddrPort("[2001:db8::2]:443")), "[2001:db8::1]:56324"},
+		{"v2 LOCAL", v2Header(0, netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("198.51.100.1:443")), "127.0.0.1:"},
+		{"missing", nil, ""},
+		{"v1 invalid", []byte("PROXY TCP4 192.0.2.1 56324 443\r\n"), ""},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), ""},
+	}
+
+	for _, tt := range tests {
+		got := remoteAddr(t, addr, tt.header)
+		if (tt.wont == "" && got != "") || !strings.HasPrefix(got, tt.wont) {
+			t.Errorf("%s: got: %q, wont: %q", tt.name, got, tt.wont)
+		}
+	}
+}
+
+func TestListener_Untrusted(t *testing.T) {
+	for _, trusted := range [][]netip.Prefix{{netip.MustParsePrefix("10.0.0.0/8")}, nil} {
+		addr := startServer(t, trusted)
+
+		// The header isn't read from an untrusted peer, so it is sent to the
+		// HTTP server as is and the request fails.
+		if got := remoteAddr(t, addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")); strings.HasPrefix(got, "192.0.2.1") {
+			t.Errorf("trusted %v: got: %q from an untrusted peer", trusted, got)
+		}
+		if got := remoteAddr(t, addr, nil); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Errorf("trusted %v: got: %q, wont: the peer address", trusted, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/clientip"
+)
+
+type RateLimitConfig struct {
+	// Requests are allowed per Per, with bursts of up to Burst requests.
+	Requests int
+	Per      time.Duration
+	Burst    int
+	// Key is "ip" (default), "path" or "header:<name>". Requests without the
+	// header are keyed by client IP. The header value is taken as is, so a
+	// client that sends a new value with every request is never limited and
+	// pushes other buckets out of MaxKeys. Only key on a header that a
+	// trusted proxy sets or overwrites, like an authenticated user ID.
+	Key            string
+	MaxKeys        int
+	TrustedProxies []netip.Prefix
+}
+
+// Limiter is a token bucket per key. Only the most recently used MaxKeys
+// buckets are kept; an evicted key starts again with a full bucket.
+type Limiter struct {
+	rate           float64
+	burst          int
+	per            time.Duration
+	key            string
+	header         string
+	maxKeys        int
+	trustedProxies []netip.Prefix
+
+	mu      sync.Mutex
+	ll      *list.List
+	buckets map[string]*list.Element
+	now     func() time.Time
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+const defaultMaxKeys = 10000
+
+func New(rlconfig *RateLimitConfig) (*Limiter, error) {
+	if rlconfig.Requests <= 0 {
+		return nil, errors.New("rate limit requests must be positive")
+	}
+	if rlconfig.Burst < 0 {
+		return nil, errors.New("rate limit burst must not be negative")
+	}
+	// A zero Per means the one second default.
+	if rlconfig.Per < 0 {
+		return nil, errors.New("rate limit per must be positive")
+	}
+	if rlconfig.MaxKeys < 0 {
+		return nil, errors.New("rate limit max keys must not be negative")
+	}
+
+	l := &Limiter{
+		burst:          rlconfig.Burst,
+		per:            rlconfig.Per,
+		maxKeys:        rlconfig.MaxKeys,
+		trustedProxies: rlconfig.TrustedProxies,
+		ll:             list.New(),
+		buckets:        map[string]*list.Element{},
+		now:            time.Now,
+	}
+	if l.per == 0 {
+		l.per = time.Second
+	}
+	if l.burst == 0 {
+		l.burst = rlconfig.Requests
+	}
+	if l.maxKeys == 0 {
+		l.maxKeys = defaultMaxKeys
+	}
+	l.rate = float64(rlconfig.Requests) / l.per.Seconds()
+
+	switch {
+	case rlconfig.Key == "" || rlconfig.Key == "ip":
+		l.key = "ip"
+	case rlconfig.Key == "path":
+		l.key = "path"
+	case strings.HasPrefix(rlconfig.Key, "header:") && len(rlconfig.Key) > len("header:"):
+		l.key = "header"
+		l.header = strings.TrimPrefix(rlconfig.Key, "header:")
+	default:
+		return nil, errors.New("rate limit key is invalid value: " + rlconfig.Key)
+	}
+
+	return l, nil
+}
+
+// Allow takes a token for the request and sets the RateLimit headers. When no
+// token is left, it responds with 429 and returns false. A nil Limiter allows
+// everything.
+func (l *Limiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+
+	remaining, wait, ok := l.take(l.requestKey(r))
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(l.burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(l.reset(remaining)))
+	h.Set("RateLimit-Policy", strconv.Itoa(l.burst)+";w="+strconv.Itoa(int(math.Ceil(l.per.Seconds()))))
+	if ok {
+		return true
+	}
+
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+func (l *Limiter) requestKey(r *http.Request) string {
+	switch l.key {
+	case "path":
+		return r.URL.Path
+	case "header":
+		if v := r.Header.Get(l.header); v != "" {
+			return "header:" + v
+		}
+	}
+
+	addr, err := clientip.FromRequest(r, l.trustedProxies)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
+
+// take refills the bucket for the elapsed time and takes one token. It
+// returns the tokens left and, when none was available, how long until one is.
+func (l *Limiter) take(key string) (int, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var b *bucket
+	if el, found := l.buckets[key]; found {
+		l.ll.MoveToFront(el)
+		b = el.Value.(*bucket)
+		b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: float64(l.burst), last: now}
+		l.buckets[key] = l.ll.PushFront(b)
+		for l.ll.Len() > l.maxKeys {
+			oldest := l.ll.Back()
+			l.ll.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return 0, wait, false
+	}
+	b.tokens--
+	return int(b.tokens), 0, true
+}
+
+// reset is the number of seconds until the bucket is full again.
+func (l *Limiter) reset(remaining int) int {
+	return int(math.Ceil(float64(l.burst-remaining) / l.rate))
+}
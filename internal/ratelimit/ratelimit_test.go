@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newLimiter(t *testing.T, rlconfig *RateLimitConfig) (*Limiter, *clock) {
+	t.Helper()
+	l, err := New(rlconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l.now = c.now
+	return l, c
+}
+
+func allow(l *Limiter, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	l.Allow(w, r)
+	return w
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newLimiter(t, &RateLimitConfig{Requests: 2, Per: time.Minute})
+
+	for i, remaining := range []string{"1", "0"} {
+		w := allow(l, "192.0.2.1:1234", nil)
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Errorf("#%d: got: %d %s, wont: 200 %s", i, w.Code, w.Header().Get("RateLimit-Remaining"), remaining)
+		}
+	}
+
+	w := allow(l, "192.0.2.1:1234", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got: %d, wont: 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("got Retry-After: %s, wont: 30", got)
+	}
+	if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+		t.Errorf("got RateLimit-Limit: %s, wont: 2", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "60" {
+		t.Errorf("got RateLimit-Reset: %s, wont: 60", got)
+	}
+
+	// Another client has its own bucket.
+	if w := allow(l, "192.0.2.2:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("got: %d, wont: 200", w.Code)
+	}
+
+	c.t = c.t.Add(30 * time.Second)
+	if w := allow(l, "192.0.2.1:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("got: %d after refill, wont: 200", w.Code)
+	}
+}
+
+func TestAllow_Keys(t *testing.T) {
+	tests := []struct {
+		key     string
+		header  http.Header
+		remotes []string
+		codes   []int
+	}{
+		{key: "ip", remotes: []string{"192.0.2.1:1", "192.0.2.1:2"}, codes: []int{200, 429}},
+		{key: "header:X-Api-Key", header: http.Header{"X-Api-Key": {"k"}}, remotes: []string{"192.0.2.1:1", "192.0.2.2:1"}, codes: []int{200, 429}},
+		{key: "header:X-Api-Key", remotes: []string{"192.0.2.1:1", "192.0.2.2:1"}, codes: []int{200, 200}},
+		{key: "path", remotes: []string{"192.0.2.1:1", "192.0.2.2:1"}, codes: []int{200, 429}},
+	}
+
+	for _, tt := range tests {
+		l, _ := newLimiter(t, &RateLimitConfig{Requests: 1, Key: tt.key})
+		for i, remote := range tt.remotes {
+			if w := allow(l, remote, tt.header); w.Code != tt.codes[i] {
+				t.Errorf("%s #%d: got: %d, wont: %d", tt.key, i, w.Code, tt.codes[i])
+			}
+		}
+	}
+}
+
+func TestAllow_Eviction(t *testing.T) {
+	l, _ := newLimiter(t, &RateLimitConfig{Requests: 1, MaxKeys: 2})
+
+	for _, remote := range []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1"} {
+		allow(l, remote, nil)
+	}
+
+	if len(l.buckets) != 2 {
+		t.Errorf("got: %d buckets, wont: 2", len(l.buckets))
+	}
+	// The oldest bucket was evicted, so the client starts over.
+	if w := allow(l, "192.0.2.1:1", nil); w.Code != http.StatusOK {
+		t.Errorf("got: %d, wont: 200", w.Code)
+	}
+}
+
+func TestAllow_Nil(t *testing.T) {
+	var l *Limiter
+	if !l.Allow(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+		t.Error("nil limiter denied a request")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []RateLimitConfig{
+		{Requests: 0},
+		{Requests: 10, Burst: -1},
+		{Requests: 10, Per: -time.Second},
+		{Requests: 10, MaxKeys: -1},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(&tt); err == nil {
+			t.Errorf("%+v: expected an error", tt)
+		}
+	}
+}
@@ -14,7 +14,14 @@ func (cw *captureWriter) WriteHeader(status int) {
 }
 
 func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
 	size, err := cw.ResponseWriter.Write(b)
 	cw.size += size
 	return size, err
 }
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
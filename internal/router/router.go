@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/y-yagi/niwa/internal/config"
+	"github.com/y-yagi/niwa/internal/logging"
+	"github.com/y-yagi/niwa/internal/mtls"
 )
 
 type Router struct {
@@ -14,17 +16,20 @@ type Router struct {
 
 func New(conf *config.Config) http.Handler {
 	var handler http.Handler
-	handler = &Router{conf: conf}
+	router := &Router{conf: conf}
+	handler = router
 
 	if conf.Timelimit != 0 {
 		handler = http.TimeoutHandler(handler, conf.Timelimit, "")
 	}
 
+	handler = &streamHandler{router: router, handler: handler}
+
 	if conf.RequestBodyMaxSize > 0 {
 		handler = http.MaxBytesHandler(handler, int64(conf.RequestBodyMaxSize))
 	}
 
-	return handler
+	return conf.SecurityHeaders.Handler(handler)
 }
 
 func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,8 +49,25 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	r = router.conf.ClientCertVerifier.Forward(r)
+	if mtls.FromRequest(r) != nil {
+		r = logging.WithClientCert(r, r.Header.Get(mtls.SubjectHeader), r.Header.Get(mtls.SANHeader))
+	}
+
+	if !router.conf.IPFilter.Allow(w, r) {
+		_ = router.conf.Logging.WriteHTTPLog(w, r, http.StatusForbidden, 0)
+		return
+	}
+
+	if !router.conf.RateLimiter.Allow(w, r) {
+		_ = router.conf.Logging.WriteHTTPLog(w, r, http.StatusTooManyRequests, 0)
+		return
+	}
+
 	if router.conf.ReverseProxy != nil {
-		router.conf.ReverseProxy.ServeHTTP(w, r)
+		cw := &captureWriter{ResponseWriter: w}
+		router.conf.ReverseProxy.ServeHTTP(cw, r)
+		_ = router.conf.Logging.WriteHTTPLog(w, r, cw.status, cw.size)
 		return
 	}
 
@@ -54,13 +76,70 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if routing, found := router.conf.RoutingMap[r.URL.Path]; found {
+	if routing, found := router.findRouting(r.URL.Path); found {
 		for _, h := range routing.Headers {
 			w.Header().Set(h.Key, h.Value)
 		}
 
+		if !routing.IPFilter.Allow(w, r) {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusForbidden, 0)
+			return
+		}
+
+		if !routing.ClientCertReq.Allow(w, r) {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusForbidden, 0)
+			return
+		}
+
+		if !routing.RateLimiter.Allow(w, r) {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusTooManyRequests, 0)
+			return
+		}
+
+		user, ok := routing.BasicAuth.Authenticate(w, r)
+		if !ok {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusUnauthorized, 0)
+			return
+		}
+		if user != "" {
+			r = logging.WithRemoteUser(r, user)
+		}
+
+		claims, ok := routing.JWT.Authenticate(w, r)
+		if !ok {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusUnauthorized, 0)
+			return
+		}
+		if claims != nil {
+			r = logging.WithClaims(r, claims)
+			if user == "" && claims["sub"] != "" {
+				r = logging.WithRemoteUser(r, claims["sub"])
+			}
+		}
+
+		if status, ok := routing.ForwardAuth.Authorize(w, r); !ok {
+			_ = routing.Logging.WriteHTTPLog(w, r, status, 0)
+			return
+		}
+
+		release, ok := routing.InflightLimiter.Acquire(w, r)
+		if !ok {
+			_ = routing.Logging.WriteHTTPLog(w, r, http.StatusServiceUnavailable, 0)
+			return
+		}
+		defer release()
+
+		var handler http.Handler
 		if routing.ReverseProxy != nil {
-			routing.ReverseProxy.ServeHTTP(w, r)
+			handler = routing.ReverseProxy
+		} else if routing.FastCGIHandler != nil {
+			handler = routing.FastCGIHandler
+		}
+
+		if handler != nil {
+			cw := &captureWriter{ResponseWriter: w}
+			handler.ServeHTTP(cw, r)
+			_ = routing.Logging.WriteHTTPLog(w, r, cw.status, cw.size)
 		}
 		return
 	}
@@ -70,6 +149,25 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if strings.HasPrefix(r.URL.Path, "/public/") {
+		if !router.conf.StaticIPFilter.Allow(w, r) {
+			_ = router.conf.Logging.WriteHTTPLog(w, r, http.StatusForbidden, 0)
+			return
+		}
+
+		if !router.conf.StaticRateLimiter.Allow(w, r) {
+			_ = router.conf.Logging.WriteHTTPLog(w, r, http.StatusTooManyRequests, 0)
+			return
+		}
+
+		user, ok := router.conf.StaticBasicAuth.Authenticate(w, r)
+		if !ok {
+			_ = router.conf.Logging.WriteHTTPLog(w, r, http.StatusUnauthorized, 0)
+			return
+		}
+		if user != "" {
+			r = logging.WithRemoteUser(r, user)
+		}
+
 		fh := http.StripPrefix("/public", http.FileServer(http.Dir(router.conf.Root)))
 		scw := &captureWriter{ResponseWriter: w}
 		fh.ServeHTTP(scw, r)
@@ -82,6 +180,30 @@ func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, msg)
 }
 
+// findRouting returns the routing for the path. An exact match wins. A routing
+// path ending with "/", like "/app/", also matches "/app" and every path under
+// it, and the longest one is used. "/" only matches the root itself.
+func (router *Router) findRouting(path string) (config.Routing, bool) {
+	if routing, found := router.conf.RoutingMap[path]; found {
+		return routing, true
+	}
+
+	var matched config.Routing
+	matchedLen := 0
+	for p, routing := range router.conf.RoutingMap {
+		if p == "/" || !strings.HasSuffix(p, "/") {
+			continue
+		}
+		if path != strings.TrimSuffix(p, "/") && !strings.HasPrefix(path, p) {
+			continue
+		}
+		if len(p) > matchedLen {
+			matched, matchedLen = routing, len(p)
+		}
+	}
+	return matched, matchedLen > 0
+}
+
 func (router *Router) isValidRequest(w http.ResponseWriter, r *http.Request) bool {
 	if len(router.conf.Host) == 0 {
 		return true
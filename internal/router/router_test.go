@@ -1,17 +1,30 @@
 package router_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/y-yagi/niwa/internal/auth"
 	"github.com/y-yagi/niwa/internal/config"
+	"github.com/y-yagi/niwa/internal/ipfilter"
+	"github.com/y-yagi/niwa/internal/logging"
+	"github.com/y-yagi/niwa/internal/mtls"
+	"github.com/y-yagi/niwa/internal/proxy"
+	"github.com/y-yagi/niwa/internal/ratelimit"
 	"github.com/y-yagi/niwa/internal/router"
 )
 
@@ -158,6 +171,140 @@ func TestRoutings(t *testing.T) {
 	}
 }
 
+func TestRoutings_PrefixMatch(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app/"] = config.Routing{Path: "/app/", ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+	conf.RoutingMap["/exact"] = config.Routing{Path: "/exact", ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := map[string]string{
+		"/app/users":  "/app/users",
+		"/app/":       "/app/",
+		"/app":        "/app",
+		"/apple":      "Hello, world",
+		"/exact":      "/exact",
+		"/exact/page": "Hello, world",
+	}
+	for path, wont := range tests {
+		body, err := getBodyFromURL(client, ts.URL+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != wont {
+			t.Errorf("%s: got: %s, wont: %s", path, body, wont)
+		}
+	}
+}
+
+func TestRoutings_WithLogging(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "app.log")
+	l, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.RequestURI}} {{.Status}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app"] = config.Routing{ReverseProxy: httputil.NewSingleHostReverseProxy(url), Logging: logging.Loggings{l}}
+
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	client := ts.Client()
+	if _, err = getBodyFromURL(client, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getBodyFromURL(client, ts.URL+"/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "/app 202\n"
+	if string(log) != wont {
+		t.Errorf("got: %s, wont: %s", log, wont)
+	}
+}
+
+func TestProxy_UpstreamDown(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	as.Close()
+
+	tempDir, err := os.MkdirTemp("", "niwatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logfile := path.Join(tempDir, "niwa.log")
+	l, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.Status}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := proxy.New(&proxy.ProxyConfig{URL: as.URL, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ReverseProxy: rp, Logging: logging.Loggings{l}}
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got: %d, wont: %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	accesslog, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(accesslog) != "503\n" {
+		t.Errorf("got: %s, wont: %s", accesslog, "503\n")
+	}
+}
+
 func TestRequestBodyMaxSize(t *testing.T) {
 	conf := &config.Config{RequestBodyMaxSize: 20}
 	ts := httptest.NewServer(router.New(conf))
@@ -290,3 +437,216 @@ func TestHost_InvalidHostHeader(t *testing.T) {
 		t.Errorf("got: %v, wont: %v", res.StatusCode, http.StatusNotFound)
 	}
 }
+
+func TestRateLimit(t *testing.T) {
+	newLimiter := func() *ratelimit.Limiter {
+		l, err := ratelimit.New(&ratelimit.RateLimitConfig{Requests: 1, Per: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	conf := &config.Config{ConfigFile: config.ConfigFile{Root: "../../testdata"}, StaticRateLimiter: newLimiter()}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app/"] = config.Routing{Path: "/app/", RateLimiter: newLimiter()}
+
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/public/user.json", http.StatusOK},
+		{"/public/user.text", http.StatusTooManyRequests},
+		{"/app", http.StatusOK},
+		{"/app/users", http.StatusTooManyRequests},
+		{"/", http.StatusOK},
+		{"/", http.StatusOK},
+	}
+
+	client := ts.Client()
+	for _, tt := range tests {
+		res, err := client.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got: %d, wont: %d", tt.path, res.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" {
+			t.Errorf("%s: Retry-After is missing", tt.path)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	newBasicAuth := func() *auth.BasicAuth {
+		a, err := auth.NewBasicAuth(&auth.BasicAuthConfig{File: "../../testdata/htpasswd"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	conf := &config.Config{ConfigFile: config.ConfigFile{Root: "../../testdata"}, StaticBasicAuth: newBasicAuth()}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app"] = config.Routing{Path: "/app", BasicAuth: newBasicAuth()}
+
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	tests := []struct {
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{"/public/user.json", "", "", http.StatusUnauthorized},
+		{"/public/user.json", "bcrypt", "wrong", http.StatusUnauthorized},
+		{"/public/user.json", "bcrypt", "secret", http.StatusOK},
+		{"/app", "", "", http.StatusUnauthorized},
+		{"/app", "sha", "secret", http.StatusOK},
+		{"/", "", "", http.StatusOK},
+	}
+
+	client := ts.Client()
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s: got: %d, wont: %d", tt.path, tt.user, res.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate is missing", tt.path)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	newFilter := func(allow, deny []string) *ipfilter.Filter {
+		ipconfig := ipfilter.IPFilterConfig{}
+		for _, p := range allow {
+			ipconfig.Allow = append(ipconfig.Allow, netip.MustParsePrefix(p))
+		}
+		for _, p := range deny {
+			ipconfig.Deny = append(ipconfig.Deny, netip.MustParsePrefix(p))
+		}
+		f, err := ipfilter.New(&ipconfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	conf := &config.Config{ConfigFile: config.ConfigFile{Root: "../../testdata"}, StaticIPFilter: newFilter(nil, []string{"127.0.0.1/32"})}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app"] = config.Routing{Path: "/app", IPFilter: newFilter([]string{"10.0.0.0/8"}, nil)}
+	conf.RoutingMap["/internal"] = config.Routing{Path: "/internal", IPFilter: newFilter([]string{"127.0.0.0/8"}, nil)}
+
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/public/user.json", http.StatusForbidden},
+		{"/app", http.StatusForbidden},
+		{"/internal", http.StatusOK},
+		{"/", http.StatusOK},
+	}
+
+	client := ts.Client()
+	for _, tt := range tests {
+		res, err := client.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got: %d, wont: %d", tt.path, res.StatusCode, tt.status)
+		}
+	}
+
+	// The global list applies to every request.
+	conf.IPFilter = newFilter(nil, []string{"127.0.0.0/8"})
+	res, err := client.Get(ts.URL + "/internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("got: %d, wont: %d", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(mtls.SubjectHeader))
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := path.Join(t.TempDir(), "app.log")
+	l, err := logging.New(&logging.LogConfig{Output: "file", FilePath: logfile, Format: "{{.Status}} {{.ClientCertSubject}} {{.ClientCertSAN}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ClientCertVerifier: mtls.NewVerifier(x509.NewCertPool())}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app"] = config.Routing{
+		ReverseProxy:  httputil.NewSingleHostReverseProxy(url),
+		Logging:       logging.Loggings{l},
+		ClientCertReq: mtls.NewRequirement(&mtls.RequirementConfig{CommonNames: []string{"client"}}),
+	}
+	handler := router.New(conf)
+
+	serve := func(cn string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/app", nil)
+		r.Header.Set(mtls.SubjectHeader, "CN=spoofed")
+		// Chains verified by the TLS handshake are used as is.
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: []string{cn + ".example.com"}}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("client"); w.Code != http.StatusOK || w.Body.String() != "CN=client" {
+		t.Errorf("got: %d %s, wont: 200 CN=client", w.Code, w.Body.String())
+	}
+	if w := serve("other"); w.Code != http.StatusForbidden {
+		t.Errorf("got: %d, wont: 403", w.Code)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "200 CN=client DNS:client.example.com\n403 CN=other DNS:other.example.com\n"
+	if string(log) != wont {
+		t.Errorf("got: %s, wont: %s", log, wont)
+	}
+}
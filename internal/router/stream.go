@@ -0,0 +1,134 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamHandler sends streaming requests (WebSocket upgrades and Server-Sent
+// Events to proxied routings, and routings marked as streaming) around the
+// timeout wrappers, which buffer the response and can't be hijacked.
+type streamHandler struct {
+	router  *Router
+	handler http.Handler
+}
+
+const defaultStreamIdleTimeout = time.Minute
+
+func (sh *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !sh.isStreaming(r) {
+		sh.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// The server's write timeout would cut long-lived responses, including
+	// hijacked connections, so drop the deadlines and rely on the idle timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	idle := sh.router.conf.StreamIdleTimeout
+	if idle == 0 {
+		idle = defaultStreamIdleTimeout
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sw := &streamWriter{ResponseWriter: w, idle: idle, timer: time.AfterFunc(idle, cancel)}
+	defer sw.timer.Stop()
+	sh.router.ServeHTTP(sw, r.WithContext(ctx))
+}
+
+// isStreaming only trusts the request headers for proxied requests, so clients
+// can't lift the time limit of static files or other handlers.
+func (sh *streamHandler) isStreaming(r *http.Request) bool {
+	streamingRequest := isUpgradeRequest(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sh.router.conf.ReverseProxy != nil {
+		return streamingRequest
+	}
+
+	routing, found := sh.router.findRouting(r.URL.Path)
+	if !found {
+		return false
+	}
+	return routing.Streaming || (streamingRequest && routing.ReverseProxy != nil)
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamWriter cancels the request once nothing was written (or, after a
+// hijack, read or written) for the idle timeout.
+type streamWriter struct {
+	http.ResponseWriter
+	idle  time.Duration
+	timer *time.Timer
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.timer.Reset(sw.idle)
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *streamWriter) Flush() {
+	sw.timer.Reset(sw.idle)
+	_ = http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	sw.timer.Reset(sw.idle)
+	return &idleConn{Conn: conn, reset: func() { sw.timer.Reset(sw.idle) }}, brw, nil
+}
+
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+type idleConn struct {
+	net.Conn
+	mu    sync.Mutex
+	reset func()
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) touch() {
+	c.mu.Lock()
+	c.reset()
+	c.mu.Unlock()
+}
@@ -0,0 +1,199 @@
+package router_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/auth"
+	"github.com/y-yagi/niwa/internal/config"
+	"github.com/y-yagi/niwa/internal/router"
+)
+
+func TestStream_Upgrade(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+
+		line, _ := brw.ReadString('\n')
+		fmt.Fprint(brw, line)
+		_ = brw.Flush()
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ReverseProxy: httputil.NewSingleHostReverseProxy(url), Timelimit: 10 * time.Millisecond}
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: niwa.test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got: %d, wont: %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// Outlive the time limit before talking over the upgraded connection.
+	time.Sleep(30 * time.Millisecond)
+	fmt.Fprint(conn, "ping\n")
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("got: %s, wont: %s", line, "ping\n")
+	}
+}
+
+func TestStream_ServerSentEvents(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			_ = http.NewResponseController(w).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ReverseProxy: httputil.NewSingleHostReverseProxy(url), Timelimit: 15 * time.Millisecond}
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wont := "data: 0\n\ndata: 1\n\ndata: 2\n\n"
+	if string(body) != wont {
+		t.Errorf("got: %q, wont: %q", body, wont)
+	}
+}
+
+func TestStream_IdleTimeout(t *testing.T) {
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		_ = http.NewResponseController(w).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			fmt.Fprint(w, "data: late\n\n")
+		}
+	}))
+	defer as.Close()
+
+	url, err := url.Parse(as.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ReverseProxy: httputil.NewSingleHostReverseProxy(url), StreamIdleTimeout: 50 * time.Millisecond}
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if strings.Contains(string(body), "late") || !strings.Contains(string(body), "first") {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestStream_NotProxied(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	forwardAuth, err := auth.NewForwardAuth(&auth.ForwardAuthConfig{URL: slow.URL, ErrorLog: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.Config{ConfigFile: config.ConfigFile{Root: "../../testdata"}, Timelimit: 20 * time.Millisecond}
+	conf.RoutingMap = map[string]config.Routing{}
+	conf.RoutingMap["/app"] = config.Routing{Path: "/app", ForwardAuth: forwardAuth}
+	ts := httptest.NewServer(router.New(conf))
+	defer ts.Close()
+
+	headers := []map[string]string{
+		{"Accept": "text/event-stream"},
+		{"Upgrade": "websocket", "Connection": "Upgrade"},
+	}
+	for _, h := range headers {
+		req, err := http.NewRequest("GET", ts.URL+"/app", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%v: got: %d, wont: %d", h, res.StatusCode, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package secheaders
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type SecurityHeadersConfig struct {
+	// Preset is "default", "strict" or empty for none.
+	Preset string
+	// Overrides replace preset values. An empty value removes the header.
+	Overrides map[string]string
+	// CSPNonce generates a nonce per request. It replaces "{nonce}" in
+	// Content-Security-Policy and is available to templates.
+	CSPNonce bool
+}
+
+// SecurityHeaders adds security headers to every response. Headers already
+// set by an upstream or [[headers]] are kept.
+type SecurityHeaders struct {
+	headers  map[string]string
+	cspNonce bool
+}
+
+const nonceToken = "{nonce}"
+
+var presets = map[string]map[string]string{
+	"default": {
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	},
+	"strict": {
+		"Strict-Transport-Security":    "max-age=63072000; includeSubDomains",
+		"X-Content-Type-Options":       "nosniff",
+		"X-Frame-Options":              "DENY",
+		"Referrer-Policy":              "no-referrer",
+		"Content-Security-Policy":      "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Resource-Policy": "same-origin",
+		"Permissions-Policy":           "camera=(), microphone=(), geolocation=()",
+	},
+}
+
+// strictNonceCSP is the strict preset's policy when nonces are enabled.
+const strictNonceCSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"
+
+type nonceContextKey struct{}
+
+func New(shconfig *SecurityHeadersConfig) (*SecurityHeaders, error) {
+	preset, found := presets[shconfig.Preset]
+	if !found && shconfig.Preset != "" {
+		return nil, errors.New("security headers is invalid value: " + shconfig.Preset)
+	}
+
+	s := &SecurityHeaders{headers: map[string]string{}, cspNonce: shconfig.CSPNonce}
+	for k, v := range preset {
+		s.headers[k] = v
+	}
+	if shconfig.Preset == "strict" && shconfig.CSPNonce {
+		s.headers["Content-Security-Policy"] = strictNonceCSP
+	}
+	for k, v := range shconfig.Overrides {
+		k = http.CanonicalHeaderKey(k)
+		if v == "" {
+			delete(s.headers, k)
+		} else {
+			s.headers[k] = v
+		}
+	}
+
+	if s.cspNonce && !strings.Contains(s.headers["Content-Security-Policy"], nonceToken) {
+		return nil, errors.New("csp nonce needs a Content-Security-Policy with " + nonceToken)
+	}
+	return s, nil
+}
+
+// Handler adds the headers to the responses of next. A nil SecurityHeaders
+// returns next.
+func (s *SecurityHeaders) Handler(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var nonce string
+		if s.cspNonce {
+			nonce = newNonce()
+			r = r.WithContext(context.WithValue(r.Context(), nonceContextKey{}, nonce))
+		}
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, s: s, tls: r.TLS != nil, nonce: nonce}, r)
+	})
+}
+
+// Nonce returns the CSP nonce of the request, or "" when nonces are disabled.
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceContextKey{}).(string)
+	return nonce
+}
+
+// newNonce returns 16 random bytes in URL-safe base64, which html/template
+// writes into attributes without escaping.
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// headerWriter fills in the headers missing from the response when it is
+// written, so the values of upstreams and handlers win.
+type headerWriter struct {
+	http.ResponseWriter
+	s           *SecurityHeaders
+	tls         bool
+	nonce       string
+	wroteHeader bool
+}
+
+func (hw *headerWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final one.
+	if !hw.wroteHeader && status >= 200 {
+		hw.wroteHeader = true
+		hw.setHeaders()
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(hw.ResponseWriter).Flush()
+}
+
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+func (hw *headerWriter) setHeaders() {
+	h := hw.ResponseWriter.Header()
+	for k, v := range hw.s.headers {
+		if _, found := h[k]; found {
+			continue
+		}
+		// Browsers ignore HSTS over plain HTTP.
+		if k == "Strict-Transport-Security" && !hw.tls {
+			continue
+		}
+		if k == "Content-Security-Policy" {
+			v = strings.ReplaceAll(v, nonceToken, hw.nonce)
+		}
+		h[k] = []string{v}
+	}
+}
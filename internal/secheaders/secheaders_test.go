@@ -0,0 +1,138 @@
+package secheaders_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/y-yagi/niwa/internal/secheaders"
+)
+
+func serve(t *testing.T, shconfig *secheaders.SecurityHeadersConfig, next http.HandlerFunc, tlsState bool) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	s, err := secheaders.New(shconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *http.Request
+	r := httptest.NewRequest("GET", "/", nil)
+	if tlsState {
+		r.TLS = &tls.ConnectionState{}
+	}
+	w := httptest.NewRecorder()
+	s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		next(w, r)
+	})).ServeHTTP(w, r)
+	return w, got
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+func TestSecurityHeaders_Presets(t *testing.T) {
+	tests := []struct {
+		preset string
+		header string
+		wont   string
+	}{
+		{"default", "X-Frame-Options", "SAMEORIGIN"},
+		{"default", "X-Content-Type-Options", "nosniff"},
+		{"default", "Content-Security-Policy", ""},
+		{"default", "Strict-Transport-Security", "max-age=31536000"},
+		{"strict", "X-Frame-Options", "DENY"},
+		{"strict", "Referrer-Policy", "no-referrer"},
+		{"strict", "Cross-Origin-Opener-Policy", "same-origin"},
+		{"strict", "Strict-Transport-Security", "max-age=63072000; includeSubDomains"},
+	}
+
+	for _, tt := range tests {
+		w, _ := serve(t, &secheaders.SecurityHeadersConfig{Preset: tt.preset}, ok, true)
+		if got := w.Header().Get(tt.header); got != tt.wont {
+			t.Errorf("%s %s: got: %q, wont: %q", tt.preset, tt.header, got, tt.wont)
+		}
+	}
+
+	w, _ := serve(t, &secheaders.SecurityHeadersConfig{Preset: "strict"}, ok, false)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("got: %q, wont: no HSTS over plain HTTP", got)
+	}
+}
+
+func TestSecurityHeaders_Overrides(t *testing.T) {
+	shconfig := &secheaders.SecurityHeadersConfig{
+		Preset:    "strict",
+		Overrides: map[string]string{"x-frame-options": "SAMEORIGIN", "Permissions-Policy": "", "X-Extra": "1"},
+	}
+	w, _ := serve(t, shconfig, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Referrer-Policy", "origin")
+		w.WriteHeader(http.StatusNotFound)
+	}, false)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got: %d, wont: 404", w.Code)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("got: %q, wont: overridden value", got)
+	}
+	if _, found := w.Header()["Permissions-Policy"]; found {
+		t.Error("removed header was sent")
+	}
+	if got := w.Header().Get("X-Extra"); got != "1" {
+		t.Errorf("got: %q, wont: added header", got)
+	}
+	if got := w.Header().Values("Referrer-Policy"); len(got) != 1 || got[0] != "origin" {
+		t.Errorf("got: %v, wont: the handler's value", got)
+	}
+}
+
+func TestSecurityHeaders_Nonce(t *testing.T) {
+	var nonce string
+	w, _ := serve(t, &secheaders.SecurityHeadersConfig{Preset: "strict", CSPNonce: true}, func(w http.ResponseWriter, r *http.Request) {
+		nonce = secheaders.Nonce(r.Context())
+		ok(w, r)
+	}, false)
+
+	if len(nonce) == 0 {
+		t.Fatal("nonce was not set")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "script-src 'self' 'nonce-"+nonce+"'") || strings.Contains(csp, "{nonce}") {
+		t.Errorf("got: %s", csp)
+	}
+
+	var second string
+	serve(t, &secheaders.SecurityHeadersConfig{Preset: "strict", CSPNonce: true}, func(w http.ResponseWriter, r *http.Request) {
+		second = secheaders.Nonce(r.Context())
+	}, false)
+	if second == nonce {
+		t.Error("nonce was reused")
+	}
+
+	_, r := serve(t, &secheaders.SecurityHeadersConfig{Preset: "strict"}, ok, false)
+	if got := secheaders.Nonce(r.Context()); got != "" {
+		t.Errorf("got: %q, wont: no nonce", got)
+	}
+}
+
+func TestSecurityHeaders_InvalidConfig(t *testing.T) {
+	if _, err := secheaders.New(&secheaders.SecurityHeadersConfig{Preset: "paranoid"}); err == nil {
+		t.Error("expected an error for an unknown preset")
+	}
+	if _, err := secheaders.New(&secheaders.SecurityHeadersConfig{Preset: "default", CSPNonce: true}); err == nil {
+		t.Error("expected an error for a nonce without a policy")
+	}
+}
+
+func TestSecurityHeaders_Nil(t *testing.T) {
+	var s *secheaders.SecurityHeaders
+	w := httptest.NewRecorder()
+	s.Handler(http.HandlerFunc(ok)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("X-Content-Type-Options"); got != "" {
+		t.Errorf("got: %q, wont: no security headers", got)
+	}
+}
@@ -2,21 +2,32 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/y-yagi/niwa/internal/cache"
 	"github.com/y-yagi/niwa/internal/config"
+	"github.com/y-yagi/niwa/internal/limit"
+	"github.com/y-yagi/niwa/internal/proxyproto"
 	"github.com/y-yagi/niwa/internal/router"
+	"github.com/y-yagi/niwa/internal/tlsconfig"
 	"golang.org/x/sync/errgroup"
 )
 
 type Server struct {
 	conf *config.Config
+
+	mu  sync.Mutex
+	tls *tlsconfig.Manager
 }
 
 func New(conf *config.Config) *Server {
@@ -33,6 +44,12 @@ func (s *Server) Start(g *errgroup.Group, ctx context.Context, done context.Canc
 
 	})
 
+	if s.conf.AdminAddress != "" {
+		g.Go(func() error {
+			return s.startAdminServer(ctx)
+		})
+	}
+
 	g.Go(func() error {
 		sighup := make(chan os.Signal, 1)
 		signal.Notify(sighup, syscall.SIGHUP)
@@ -40,9 +57,22 @@ func (s *Server) Start(g *errgroup.Group, ctx context.Context, done context.Canc
 		for {
 			select {
 			case <-sighup:
-				if err := s.conf.Logging.Reopen(); err != nil {
+				s.conf.ErrorLogging.Info("received SIGHUP, reopening log files and reloading credentials and TLS files")
+				if err := s.conf.Loggings().Reopen(); err != nil {
+					s.conf.ErrorLogging.Error("access log reopen failed", "error", err)
+					return err
+				}
+				if err := s.conf.ErrorLogging.Reopen(); err != nil {
+					s.conf.ErrorLogging.Error("error log reopen failed", "error", err)
 					return err
 				}
+				// A broken htpasswd file keeps the previous users, so keep serving.
+				if err := s.conf.ReloadCredentials(); err != nil {
+					s.conf.ErrorLogging.Error("credentials reload failed", "error", err)
+				}
+				if err := s.reloadTLS(); err != nil {
+					s.conf.ErrorLogging.Error("TLS reload failed", "error", err)
+				}
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -56,6 +86,7 @@ func (s *Server) Start(g *errgroup.Group, ctx context.Context, done context.Canc
 
 		select {
 		case <-stop:
+			s.conf.ErrorLogging.Info("received interrupt, shutting down")
 			done()
 		case <-ctx.Done():
 			return ctx.Err()
@@ -66,23 +97,49 @@ func (s *Server) Start(g *errgroup.Group, ctx context.Context, done context.Canc
 }
 
 func (s *Server) startHttpServer(ctx context.Context) error {
+	var handler http.Handler = s.buildServeMux()
+	if s.conf.MaxConnections > 0 {
+		handler = limit.RejectHandler(handler)
+	}
+
 	httpserver := &http.Server{
 		Addr:              ":" + s.port(),
-		Handler:           s.buildServeMux(),
+		Handler:           handler,
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.conf.ErrorLogging.StdLogger(),
+	}
+
+	l, err := net.Listen("tcp", httpserver.Addr)
+	if err != nil {
+		return err
+	}
+	if s.conf.ProxyProtocol {
+		l = proxyproto.NewListener(l, s.conf.ProxyProtocolFrom, 0)
+	}
+	if s.conf.MaxConnections > 0 {
+		l = limit.NewListener(l, s.conf.MaxConnections)
+		httpserver.ConnContext = limit.ConnContext
+	}
+
+	useTLS := len(s.conf.Certfile) > 0 && len(s.conf.Keyfile) > 0
+	if useTLS {
+		if httpserver.TLSConfig, err = s.tlsConfig(); err != nil {
+			l.Close()
+			return err
+		}
 	}
 
 	errCh := make(chan error)
 	go func() {
 		defer close(errCh)
-		if len(s.conf.Certfile) > 0 && len(s.conf.Keyfile) > 0 {
-			if err := httpserver.ListenAndServeTLS(s.conf.Certfile, s.conf.Keyfile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if useTLS {
+			if err := httpserver.ServeTLS(l, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				errCh <- err
 			}
 		} else {
-			if err := httpserver.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err := httpserver.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				errCh <- err
 			}
 		}
@@ -98,11 +155,137 @@ func (s *Server) startHttpServer(ctx context.Context) error {
 	}
 }
 
+// startHttp3Server serves HTTP/3 over QUIC and, for clients that don't know
+// about it yet, HTTPS over TCP with an Alt-Svc header. Both share one TLS
+// configuration.
 func (s *Server) startHttp3Server(ctx context.Context) error {
+	tlsconf, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	addr := ":" + s.port()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+
+	var handler http.Handler = s.buildServeMux()
+	if s.conf.MaxConnections > 0 {
+		handler = limit.RejectHandler(handler)
+	}
+	quicserver := &http3.Server{TLSConfig: tlsconf, Handler: handler}
+	httpserver := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = quicserver.SetQuicHeaders(w.Header())
+			handler.ServeHTTP(w, r)
+		}),
+		TLSConfig:         tlsconf,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.conf.ErrorLogging.StdLogger(),
+	}
+
+	var ql http3.QUICEarlyListener
+	if ql, err = quic.ListenEarly(udpConn, http3.ConfigureTLSConfig(tlsconf), &quic.Config{Allow0RTT: true}); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		ql.Close()
+		return err
+	}
+	if s.conf.MaxConnections > 0 {
+		ll := limit.NewListener(l, s.conf.MaxConnections)
+		l, ql = ll, ll.QUIC(ql)
+		httpserver.ConnContext = limit.ConnContext
+		quicserver.ConnContext = limit.QUICConnContext
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		if err := httpserver.ServeTLS(l, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+	go func() {
+		if err := quicserver.ServeListener(ql); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		quicserver.Close()
+		httpserver.Close()
+		return err
+	case <-ctx.Done():
+		quicserver.Close()
+		tctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return httpserver.Shutdown(tctx)
+	}
+}
+
+// tlsConfig loads the certificate and the tls_* settings, shared by the TCP
+// and QUIC listeners. SIGHUP reloads the files.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tc := s.conf.TLS
+	tc.Certfile, tc.Keyfile = s.conf.Certfile, s.conf.Keyfile
+	tc.ClientCAs, tc.ClientAuth = s.conf.ClientCAs, s.conf.ClientAuthType
+
+	m, err := tlsconfig.New(&tc)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.tls = m
+	s.mu.Unlock()
+	return m.Config(), nil
+}
+
+func (s *Server) reloadTLS() error {
+	s.mu.Lock()
+	m := s.tls
+	s.mu.Unlock()
+
+	if m == nil {
+		return nil
+	}
+	return m.Reload()
+}
+
+// startAdminServer serves the admin API. It listens on loopback unless
+// admin_allow or admin_auth_basic restricts who may use it.
+func (s *Server) startAdminServer(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/cache", cache.PurgeHandler(s.conf.HTTPCache))
+
+	adminserver := &http.Server{
+		Addr: s.conf.AdminAddress,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.conf.AdminIPFilter.Allow(w, r) {
+				return
+			}
+			if _, ok := s.conf.AdminBasicAuth.Authenticate(w, r); !ok {
+				return
+			}
+			mux.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.conf.ErrorLogging.StdLogger(),
+	}
+
 	errCh := make(chan error)
 	go func() {
 		defer close(errCh)
-		if err := http3.ListenAndServe(":"+s.port(), s.conf.Certfile, s.conf.Keyfile, s.buildServeMux()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := adminserver.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			errCh <- err
 		}
 	}()
@@ -111,7 +294,9 @@ func (s *Server) startHttp3Server(ctx context.Context) error {
 	case err := <-errCh:
 		return err
 	case <-ctx.Done():
-		return nil
+		tctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return adminserver.Shutdown(tctx)
 	}
 }
 
@@ -0,0 +1,259 @@
+package tlsconfig
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type TLSConfig struct {
+	Certfile         string
+	Keyfile          string
+	MinVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// NextProtos are the ALPN protocols offered over TCP. HTTP/3 always
+	// negotiates h3.
+	NextProtos []string
+	// SessionTicketKeyFile has base64 encoded 32 byte keys, one per line. The
+	// first key encrypts new tickets; the others only decrypt, so a key can
+	// be rotated out by prepending a new one.
+	SessionTicketKeyFile string
+	// OCSPStapleFile is a DER encoded OCSP response for the certificate.
+	OCSPStapleFile string
+	ClientCAs      *x509.CertPool
+	ClientAuth     tls.ClientAuthType
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+var alpnProtocols = []string{"h2", "http/1.1"}
+
+// ParseVersion parses "1.2" or "1.3". TLS 1.2 is the default.
+func ParseVersion(v string) (uint16, error) {
+	if v == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, found := versions[v]
+	if !found {
+		return 0, errors.New("tls min version is invalid value: " + v)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites parses TLS 1.0-1.2 cipher suite names such as
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Suites known to be insecure and
+// TLS 1.3 suites, which aren't configurable, are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i == -1 {
+			return nil, errors.New("tls cipher suite is invalid value: " + name)
+		}
+		suite := tls.CipherSuites()[i]
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, errors.New("tls cipher suite is not configurable: " + name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// ParseCurves parses "X25519", "P-256", "P-384" and "P-521".
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		id, found := curves[name]
+		if !found {
+			return nil, errors.New("tls curve is invalid value: " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseALPN checks the protocols. "h2" and "http/1.1" are the default.
+func ParseALPN(protos []string) ([]string, error) {
+	if len(protos) == 0 {
+		return alpnProtocols, nil
+	}
+	for _, p := range protos {
+		if !slices.Contains(alpnProtocols, p) {
+			return nil, errors.New("tls alpn is invalid value: " + p)
+		}
+	}
+	return protos, nil
+}
+
+// Validate reports settings that can't work together. HTTP/2 requires
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or its ECDSA variant when TLS 1.2
+// is allowed.
+func (c *TLSConfig) Validate() error {
+	if len(c.CipherSuites) == 0 || c.MinVersion >= tls.VersionTLS13 || !slices.Contains(c.NextProtos, "h2") {
+		return nil
+	}
+	if !slices.Contains(c.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) && !slices.Contains(c.CipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return errors.New("tls cipher suites must include an AES_128_GCM_SHA256 ECDHE suite for h2")
+	}
+	return nil
+}
+
+// Manager holds the TLS configuration of the servers. Reload reads the
+// certificate, session ticket keys and OCSP response again; handshakes after
+// that use them.
+type Manager struct {
+	config  *TLSConfig
+	current atomic.Pointer[tls.Config]
+}
+
+func New(tlsconfig *TLSConfig) (*Manager, error) {
+	if err := tlsconfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{config: tlsconfig}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Config returns the configuration to give to a server. It picks the current
+// configuration for each handshake.
+func (m *Manager) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: m.config.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return m.current.Load(), nil
+		},
+		// Never used, since every handshake gets a config with the
+		// certificate, but servers refuse to start without one.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &m.current.Load().Certificates[0], nil
+		},
+	}
+}
+
+// Reload builds a new configuration from the files. On error the current
+// configuration is kept.
+func (m *Manager) Reload() error {
+	cert, err := tls.LoadX509KeyPair(m.config.Certfile, m.config.Keyfile)
+	if err != nil {
+		return err
+	}
+	if m.config.OCSPStapleFile != "" {
+		if cert.OCSPStaple, err = readOCSPStaple(m.config.OCSPStapleFile, cert); err != nil {
+			return err
+		}
+	}
+
+	conf := &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		MinVersion:       m.config.MinVersion,
+		CipherSuites:     m.config.CipherSuites,
+		CurvePreferences: m.config.CurvePreferences,
+		NextProtos:       m.config.NextProtos,
+		ClientCAs:        m.config.ClientCAs,
+		ClientAuth:       m.config.ClientAuth,
+	}
+	if conf.MinVersion == 0 {
+		conf.MinVersion = tls.VersionTLS12
+	}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = alpnProtocols
+	}
+	if m.config.SessionTicketKeyFile != "" {
+		keys, err := readSessionTicketKeys(m.config.SessionTicketKeyFile)
+		if err != nil {
+			return err
+		}
+		conf.SetSessionTicketKeys(keys)
+	}
+
+	m.current.Store(conf)
+	return nil
+}
+
+func readSessionTicketKeys(file string) ([][32]byte, error) {
+	b, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: session ticket key must be 32 bytes in base64", file, n)
+		}
+		keys = append(keys, [32]byte(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no session ticket keys found", file)
+	}
+	return keys, nil
+}
+
+// readOCSPStaple reads the response and checks that it is a good, current
+// response for the certificate. The signature is checked when the chain
+// includes the issuer.
+func readOCSPStaple(file string, cert tls.Certificate) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		if issuer, err = x509.ParseCertificate(cert.Certificate[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := ocsp.ParseResponseForCert(b, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if res.Status != ocsp.Good {
+		return nil, fmt.Errorf("%s: certificate status is not good", file)
+	}
+	if !res.NextUpdate.IsZero() && res.NextUpdate.Before(time.Now()) {
+		return nil, fmt.Errorf("%s: OCSP response is expired", file)
+	}
+	return b, nil
+}
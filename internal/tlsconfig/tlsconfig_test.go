@@ -0,0 +1,246 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-yagi/niwa/internal/tlsconfig"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCert struct {
+	certfile string
+	keyfile  string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	pool     *x509.CertPool
+}
+
+func newTestCert(t *testing.T) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tc := testCert{certfile: filepath.Join(dir, "cert.pem"), keyfile: filepath.Join(dir, "key.pem"), cert: cert, key: key, pool: x509.NewCertPool()}
+	tc.pool.AddCert(cert)
+	if err := os.WriteFile(tc.certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func (tc testCert) ocspResponse(t *testing.T, status int, nextUpdate time.Time) []byte {
+	t.Helper()
+	b, err := ocsp.CreateResponse(tc.cert, tc.cert, ocsp.Response{Status: status, SerialNumber: tc.cert.SerialNumber, ThisUpdate: time.Now().Add(-time.Hour), NextUpdate: nextUpdate}, tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// handshake connects with client and returns the connection state the
+// client saw.
+func handshake(t *testing.T, m *tlsconfig.Manager, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = tls.Server(c, m.Config()).Handshake()
+	}()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), client)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer c.Close()
+	return c.ConnectionState(), nil
+}
+
+func TestManager(t *testing.T) {
+	tc := newTestCert(t)
+	staple := filepath.Join(t.TempDir(), "ocsp.der")
+	if err := os.WriteFile(staple, tc.ocspResponse(t, ocsp.Good, time.Now().Add(time.Hour)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := tlsconfig.New(&tlsconfig.TLSConfig{
+		Certfile:         tc.certfile,
+		Keyfile:          tc.keyfile,
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.CurveP384},
+		NextProtos:       []string{"http/1.1"},
+		OCSPStapleFile:   staple,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := handshake(t, m, &tls.Config{RootCAs: tc.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("got cipher suite: %s", tls.CipherSuiteName(state.CipherSuite))
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("got protocol: %s, wont: http/1.1", state.NegotiatedProtocol)
+	}
+	if len(state.OCSPResponse) == 0 {
+		t.Error("OCSP response was not stapled")
+	}
+
+	if _, err := handshake(t, m, &tls.Config{RootCAs: tc.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Error("TLS 1.1 handshake succeeded")
+	}
+	if _, err := handshake(t, m, &tls.Config{RootCAs: tc.pool, ServerName: "localhost", CurvePreferences: []tls.CurveID{tls.X25519}}); err == nil {
+		t.Error("handshake with an unconfigured curve succeeded")
+	}
+}
+
+func TestManager_Reload(t *testing.T) {
+	tc := newTestCert(t)
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "ticket.keys")
+	staple := filepath.Join(dir, "ocsp.der")
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := os.WriteFile(keys, []byte("# current\n"+key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staple, tc.ocspResponse(t, ocsp.Good, time.Now().Add(time.Hour)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := tlsconfig.New(&tlsconfig.TLSConfig{Certfile: tc.certfile, Keyfile: tc.keyfile, SessionTicketKeyFile: keys, OCSPStapleFile: staple})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		file  string
+		data  []byte
+		error string
+	}{
+		{"short key", keys, []byte(base64.StdEncoding.EncodeToString(make([]byte, 16))), "32 bytes"},
+		{"no keys", keys, []byte("# none\n"), "no session ticket keys"},
+		{"revoked", staple, tc.ocspResponse(t, ocsp.Revoked, time.Now().Add(time.Hour)), "not good"},
+		{"expired", staple, tc.ocspResponse(t, ocsp.Good, time.Now().Add(-time.Minute)), "expired"},
+	}
+
+	for _, tt := range tests {
+		old, err := os.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tt.file, tt.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Reload(); err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s: got: %v, wont: %s", tt.name, err, tt.error)
+		}
+		if err := os.WriteFile(tt.file, old, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The configuration from before the failed reloads is still served.
+	if state, err := handshake(t, m, &tls.Config{RootCAs: tc.pool, ServerName: "localhost"}); err != nil || len(state.OCSPResponse) == 0 {
+		t.Errorf("got: %v, stapled: %v", err, len(state.OCSPResponse) != 0)
+	}
+	if err := m.Reload(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if v, err := tlsconfig.ParseVersion(""); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("got: %v %v, wont: TLS 1.2 by default", v, err)
+	}
+	if v, err := tlsconfig.ParseVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("got: %v %v, wont: TLS 1.3", v, err)
+	}
+	if _, err := tlsconfig.ParseVersion("1.4"); err == nil {
+		t.Error("expected an error for 1.4")
+	}
+
+	if ids, err := tlsconfig.ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}); err != nil || len(ids) != 1 {
+		t.Errorf("got: %v %v", ids, err)
+	}
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256", "unknown"} {
+		if _, err := tlsconfig.ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+
+	if _, err := tlsconfig.ParseCurves([]string{"X25519", "P-256"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := tlsconfig.ParseCurves([]string{"P-224"}); err == nil {
+		t.Error("expected an error for P-224")
+	}
+
+	if protos, err := tlsconfig.ParseALPN(nil); err != nil || strings.Join(protos, ",") != "h2,http/1.1" {
+		t.Errorf("got: %v %v, wont: h2 and http/1.1 by default", protos, err)
+	}
+	if _, err := tlsconfig.ParseALPN([]string{"h3"}); err == nil {
+		t.Error("expected an error for h3")
+	}
+
+	h2 := &tlsconfig.TLSConfig{MinVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, NextProtos: []string{"h2"}}
+	if err := h2.Validate(); err == nil {
+		t.Error("expected an error for h2 without a required cipher suite")
+	}
+}
@@ -59,7 +59,7 @@ func run(args []string, outStream, errStream io.Writer) (exitCode int) {
 		/* #nosec G306 */
 		err := os.WriteFile(conf.PidFile, pid, 0644)
 		if err != nil {
-			fmt.Fprintf(errStream, "pid file creating was error%+v\n", err)
+			conf.ErrorLogging.Error("pid file creating was error", "error", err)
 			exitCode = 1
 			return
 		}
@@ -73,9 +73,13 @@ func run(args []string, outStream, errStream io.Writer) (exitCode int) {
 	server.Start(g, gctx, done)
 
 	if err := g.Wait(); err != nil && !errors.Is(err, context.Canceled) {
-		fmt.Println(err)
+		conf.ErrorLogging.Error("server stopped", "error", err)
 		exitCode = 1
 	}
 
+	if err := conf.Loggings().Close(); err != nil {
+		conf.ErrorLogging.Error("access log close failed", "error", err)
+	}
+
 	return
 }